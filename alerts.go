@@ -0,0 +1,837 @@
+package mackerelfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
+)
+
+// recentAlertsWindow is how far back the closed alerts of a host or a
+// service are listed.
+const recentAlertsWindow = 7 * 24 * time.Hour
+
+// alertHistoryDays is the number of the days listed in alerts/history.
+const alertHistoryDays = 30
+
+// alertsFS returns the file system of the alerts of an organization. The
+// open alerts are listed by ID, and all the alerts by the day they are
+// opened in the history directory. Reading the events file returns the
+// alerts opened and closed. Reading the clone file in the filters
+// directory makes a filter of the events and returns its name; the
+// directory of the name has the ctl file setting the filter and the
+// events file reading the events passed by it, and is removed when the
+// clone file is closed.
+func alertsFS(c *client, dir string) fs.FS {
+	m, _ := newItemFS(c, dir, alertItems(c, c.findOpenAlerts))
+	p := &alertPoller{client: c}
+	p.events = newFeed[*alertEvent](p.run)
+	m.Pipe("events", muxfs.FuncFile(func(name string, flag int) (fs.File, error) {
+		return p.events.open(name, flag, nil)
+	}))
+	a := &alertFilters{events: p.events, m: make(map[string]fs.FS)}
+	filters := muxfs.NewFS()
+	filters.VarFS(a)
+	filters.File("clone", muxfs.FuncFile(func(name string, flag int) (fs.File, error) {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		return &alertFilterClone{name: name, filters: a}, nil
+	}))
+	m.FS("filters", filters)
+	m.FS("history", alertHistoryFS(c, path.Join(dir, "history")))
+	return m
+}
+
+// alertHistoryFS returns the file system of the alerts opened in each of
+// the last alertHistoryDays days in UTC, named as 2006-01-02. The alerts
+// of all the days are fetched at once, and fetched again when the day
+// changes or a ctl file reloads them.
+func alertHistoryFS(c *client, dir string) fs.FS {
+	h := &alertHistory{client: c, dir: dir}
+	m := muxfs.NewFS()
+	m.VarFS(h)
+	m.ModTime(h.modTime)
+	m.File("ctl", h.ctl())
+	return m
+}
+
+// alertHistory is the VarFS of alerts/history. The days are listed
+// without fetching the alerts.
+type alertHistory struct {
+	*client
+	dir string
+
+	// loadMu serializes load across the fetch, so that the alerts are
+	// fetched once for all the days.
+	loadMu sync.Mutex
+
+	mu     sync.Mutex
+	today  time.Time                    // the last day of days and fss
+	days   map[string][]*mackerel.Alert // by day; nil until loaded
+	fss    map[string]fs.FS             // by day; made on lookup
+	loaded time.Time
+}
+
+// historyToday returns the start of the current day in UTC.
+func historyToday() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// historyDays returns the names of the days listed on today.
+func historyDays(today time.Time) []string {
+	names := make([]string, alertHistoryDays)
+	for i := range names {
+		names[i] = today.AddDate(0, 0, -i).Format(time.DateOnly)
+	}
+	return names
+}
+
+func (h *alertHistory) modTime() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.loaded
+}
+
+// expire drops the loaded alerts and the file systems of the days if
+// they are not of today. h.mu must be held.
+func (h *alertHistory) expire(today time.Time) {
+	if !h.today.Equal(today) {
+		h.today = today
+		h.days = nil
+		h.fss = make(map[string]fs.FS)
+	}
+}
+
+func (h *alertHistory) ctl() muxfs.File {
+	return muxfs.CtlFileUsage("reload", func(s string) error {
+		f := strings.Fields(s)
+		if len(f) > 0 && f[0] == "reload" {
+			return h.reload()
+		}
+		return nil
+	})
+}
+
+func (h *alertHistory) All() (muxfs.Seq[string], error) {
+	names := historyDays(historyToday())
+	return func(yield func(string) bool) {
+		for _, name := range names {
+			if !yield(name) {
+				return
+			}
+		}
+	}, nil
+}
+
+func (h *alertHistory) FS(name string) (fs.FS, bool) {
+	today := historyToday()
+	if !slices.Contains(historyDays(today), name) {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(today)
+	if fsys, ok := h.fss[name]; ok {
+		return fsys, true
+	}
+	varFS := newItemVarFS(h.client, path.Join(h.dir, name), alertItems(h.client, func() ([]*mackerel.Alert, error) {
+		return h.day(name)
+	}))
+	m := muxfs.NewFS()
+	m.VarFS(varFS)
+	m.ModTime(varFS.modTime)
+	m.File("ctl", h.ctl())
+	h.fss[name] = m
+	return m, true
+}
+
+// day returns the alerts opened on the day of the name, loading the
+// alerts of all the days if they are not yet.
+func (h *alertHistory) day(name string) ([]*mackerel.Alert, error) {
+	h.loadMu.Lock()
+	defer h.loadMu.Unlock()
+	h.mu.Lock()
+	h.expire(historyToday())
+	days := h.days
+	h.mu.Unlock()
+	if days == nil {
+		var err error
+		if days, err = h.loadLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return days[name], nil
+}
+
+// reload fetches the alerts again, and makes the file systems of the
+// days again so that they list the fetched alerts.
+func (h *alertHistory) reload() error {
+	h.loadMu.Lock()
+	defer h.loadMu.Unlock()
+	h.mu.Lock()
+	h.fss = make(map[string]fs.FS)
+	h.mu.Unlock()
+	_, err := h.loadLocked()
+	return err
+}
+
+// loadLocked fetches the alerts opened in the days listed today, and
+// splits them by day. h.loadMu must be held.
+func (h *alertHistory) loadLocked() (map[string][]*mackerel.Alert, error) {
+	today := historyToday()
+	alerts, err := h.findAlertsSince(today.AddDate(0, 0, 1-alertHistoryDays).Unix())
+	if err != nil {
+		return nil, err
+	}
+	days := make(map[string][]*mackerel.Alert)
+	for _, a := range alerts {
+		name := time.Unix(a.OpenedAt, 0).UTC().Format(time.DateOnly)
+		days[name] = append(days[name], a)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(today)
+	h.days = days
+	h.loaded = time.Now()
+	h.stats.reload(h.dir, h.loaded)
+	return days, nil
+}
+
+// hostAlertsFS returns the file system of the open and recent alerts of
+// the host.
+func hostAlertsFS(c *client, dir, hostID string) fs.FS {
+	return recentAlertsFS(c, dir, func(r *recentAlertIndex, a *mackerel.Alert) bool {
+		return a.HostID == hostID
+	})
+}
+
+// serviceAlertsFS returns the file system of the open and recent alerts
+// of the service: those of its hosts and of its monitors.
+func serviceAlertsFS(c *client, dir, serviceName string) fs.FS {
+	return recentAlertsFS(c, dir, func(r *recentAlertIndex, a *mackerel.Alert) bool {
+		return r.hostServices[a.HostID][serviceName] || r.monitorServices[a.MonitorID] == serviceName
+	})
+}
+
+// recentAlertsFS returns the file system of the alerts of recentAlerts
+// for which keep returns true. Reloading it fetches the alerts again.
+func recentAlertsFS(c *client, dir string, keep func(r *recentAlertIndex, a *mackerel.Alert) bool) fs.FS {
+	m, varFS := newItemFS(c, dir, alertItems(c, func() ([]*mackerel.Alert, error) {
+		r, err := c.recentAlerts()
+		if err != nil {
+			return nil, err
+		}
+		return filterAlerts(r.alerts, func(a *mackerel.Alert) bool {
+			return keep(r, a)
+		}), nil
+	}))
+	varFS.expire = c.recent.expire
+	return m
+}
+
+// recentAlertsMaxAge is how long the alerts fetched by recentAlerts are
+// shared by the alerts directories of the hosts and the services, so that
+// listing them all fetches the alerts once.
+const recentAlertsMaxAge = 30 * time.Second
+
+// recentAlertCache is the cache of recentAlerts of an organization.
+type recentAlertCache struct {
+	// loadMu serializes the fetch, so that the alerts are fetched once
+	// for the directories loaded at the same time.
+	loadMu sync.Mutex
+
+	mu      sync.Mutex
+	v       *recentAlertIndex // nil until fetched
+	fetched time.Time
+}
+
+// recentAlertIndex is the open and recent alerts of an organization with
+// the services of their hosts and monitors.
+type recentAlertIndex struct {
+	alerts          []*mackerel.Alert
+	hostServices    map[string]map[string]bool // by host ID
+	monitorServices map[string]string          // by monitor ID; see monitorService
+}
+
+// expire makes the next recentAlerts fetch the alerts.
+func (r *recentAlertCache) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.v = nil
+}
+
+// recentAlerts returns the open and recent alerts, fetched within
+// recentAlertsMaxAge.
+func (c *client) recentAlerts() (*recentAlertIndex, error) {
+	r := &c.recent
+	cached := func() *recentAlertIndex {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.v == nil || time.Since(r.fetched) >= recentAlertsMaxAge {
+			return nil
+		}
+		return r.v
+	}
+	if v := cached(); v != nil {
+		return v, nil
+	}
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+	// Another fetch may have finished while waiting for loadMu.
+	if v := cached(); v != nil {
+		return v, nil
+	}
+
+	alerts, err := c.findRecentAlerts()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := c.FindHosts(&mackerel.FindHostsParam{})
+	if err != nil {
+		return nil, err
+	}
+	monitors, err := c.FindMonitors()
+	if err != nil {
+		return nil, err
+	}
+	v := &recentAlertIndex{
+		alerts:          alerts,
+		hostServices:    make(map[string]map[string]bool),
+		monitorServices: make(map[string]string),
+	}
+	for _, h := range hosts {
+		services := make(map[string]bool)
+		for s := range h.Roles {
+			services[s] = true
+		}
+		v.hostServices[h.ID] = services
+	}
+	for _, m := range monitors {
+		if s := monitorService(m); s != "" {
+			v.monitorServices[m.MonitorID()] = s
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.v = v
+	r.fetched = time.Now()
+	return v, nil
+}
+
+// alertItems returns the fetch function of itemFS listing the alerts found
+// by find by ID.
+func alertItems(c *client, find func() ([]*mackerel.Alert, error)) func() (Seq2[string, fs.FS], error) {
+	return func() (Seq2[string, fs.FS], error) {
+		alerts, err := find()
+		return func(yield func(string, fs.FS) bool) {
+			for _, a := range alerts {
+				if !yield(a.ID, alertFS(c, a)) {
+					return
+				}
+			}
+		}, err
+	}
+}
+
+// alertFS returns the file system of the alert a, modified when a is
+// opened. Its memo is read on the first read, and updated when closed
+// after written. Until read, the memo is described by a, so that listing
+// the alert does not fetch it.
+func alertFS(c *client, a *mackerel.Alert) fs.FS {
+	openedAt := time.Unix(a.OpenedAt, 0)
+	m := muxfs.NewFS()
+	m.ModTime(func() time.Time { return openedAt })
+	for name, format := range map[string]func(b *bytes.Buffer){
+		"status":    func(b *bytes.Buffer) { line(b, a.Status) },
+		"type":      func(b *bytes.Buffer) { line(b, a.Type) },
+		"monitorId": func(b *bytes.Buffer) { line(b, a.MonitorID) },
+		"hostId":    func(b *bytes.Buffer) { line(b, a.HostID) },
+		"message":   func(b *bytes.Buffer) { line(b, a.Message) },
+		"reason":    func(b *bytes.Buffer) { line(b, a.Reason) },
+		"openedAt":  func(b *bytes.Buffer) { timeLine(b, a.OpenedAt) },
+		"closedAt":  func(b *bytes.Buffer) { timeLine(b, a.ClosedAt) },
+	} {
+		format := format
+		m.File(name, muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+			b := new(bytes.Buffer)
+			format(b)
+			return bytes.NewReader(b.Bytes()), openedAt, nil
+		}))
+	}
+	m.File("memo", muxfs.LazyWritableFile(func() (int64, time.Time) {
+		b := new(bytes.Buffer)
+		line(b, a.Memo)
+		return int64(b.Len()), openedAt
+	}, func() (io.Reader, time.Time, error) {
+		v, err := c.GetAlert(a.ID)
+		if err != nil {
+			return nil, time.Time{}, fsError(err)
+		}
+		b := new(bytes.Buffer)
+		line(b, v.Memo)
+		return bytes.NewReader(b.Bytes()), time.Now(), nil
+	}, func(b []byte) error {
+		if err := c.writable(); err != nil {
+			return err
+		}
+		return fsError(c.updateAlertMemo(a.ID, strings.TrimSuffix(string(b), "\n")))
+	}))
+	m.File("info", jsonFile(a, openedAt))
+	return m
+}
+
+// updateAlertMemo is UpdateAlert sending memo even if it is empty, which
+// mackerel.UpdateAlertParam omits.
+func (c *client) updateAlertMemo(id, memo string) error {
+	body, err := json.Marshal(struct {
+		Memo string `json:"memo"`
+	}{memo})
+	if err != nil {
+		return err
+	}
+	u := *c.BaseURL
+	u.Path = "/api/v0/alerts/" + url.PathEscape(id)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Request(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// findOpenAlerts returns the open alerts.
+func (c *client) findOpenAlerts() ([]*mackerel.Alert, error) {
+	var alerts []*mackerel.Alert
+	resp, err := c.FindAlerts()
+	for {
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, resp.Alerts...)
+		if resp.NextID == "" {
+			return alerts, nil
+		}
+		resp, err = c.FindAlertsByNextID(resp.NextID)
+	}
+}
+
+// findAlertsSince returns the open and closed alerts opened at the Unix
+// time since or later. The API lists the alerts newest first, so that
+// it stops paging at the first alert opened before since.
+func (c *client) findAlertsSince(since int64) ([]*mackerel.Alert, error) {
+	var alerts []*mackerel.Alert
+	resp, err := c.FindWithClosedAlerts()
+	for {
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range resp.Alerts {
+			if a.OpenedAt < since {
+				return alerts, nil
+			}
+			alerts = append(alerts, a)
+		}
+		if resp.NextID == "" {
+			return alerts, nil
+		}
+		resp, err = c.FindWithClosedAlertsByNextID(resp.NextID)
+	}
+}
+
+// findRecentAlerts returns the open alerts and the alerts opened in
+// recentAlertsWindow.
+func (c *client) findRecentAlerts() ([]*mackerel.Alert, error) {
+	alerts, err := c.findOpenAlerts()
+	if err != nil {
+		return nil, err
+	}
+	recent, err := c.findAlertsSince(time.Now().Add(-recentAlertsWindow).Unix())
+	if err != nil {
+		return nil, err
+	}
+	open := make(map[string]bool)
+	for _, a := range alerts {
+		open[a.ID] = true
+	}
+	for _, a := range recent {
+		if !open[a.ID] {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts, nil
+}
+
+// filterAlerts returns the alerts for which keep returns true.
+func filterAlerts(alerts []*mackerel.Alert, keep func(a *mackerel.Alert) bool) []*mackerel.Alert {
+	var s []*mackerel.Alert
+	for _, a := range alerts {
+		if keep(a) {
+			s = append(s, a)
+		}
+	}
+	return s
+}
+
+// monitorService returns the service monitored by m, or "" if m does not
+// monitor a service.
+func monitorService(m mackerel.Monitor) string {
+	switch m := m.(type) {
+	case *mackerel.MonitorServiceMetric:
+		return m.Service
+	case *mackerel.MonitorExternalHTTP:
+		return m.Service
+	}
+	return ""
+}
+
+// alertPoller polls the open alerts of an organization while the events
+// are read, and sends the alerts opened or closed since the previous poll
+// to events.
+type alertPoller struct {
+	*client
+	events *feed[*alertEvent]
+
+	monitorsMu sync.Mutex
+	monitors   map[string]mackerel.Monitor // by ID; nil if not found
+}
+
+// run polls alerts until stop is closed. The first poll only takes the
+// alerts already open. A failed poll is retried on the next tick.
+func (p *alertPoller) run(stop <-chan struct{}) {
+	t := time.NewTicker(p.interval())
+	defer t.Stop()
+	var known map[string]*mackerel.Alert // nil until a poll succeeds
+	for {
+		alerts, err := p.openAlerts()
+		if err == nil {
+			if known != nil {
+				p.events.send(p.changes(known, alerts))
+			}
+			known = alerts
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// openAlerts returns the open alerts by ID.
+func (p *alertPoller) openAlerts() (map[string]*mackerel.Alert, error) {
+	alerts, err := p.findOpenAlerts()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]*mackerel.Alert)
+	for _, a := range alerts {
+		m[a.ID] = a
+	}
+	return m, nil
+}
+
+// changes returns the events of the alerts opened or closed between known
+// and alerts, in order of time.
+func (p *alertPoller) changes(known, alerts map[string]*mackerel.Alert) []*alertEvent {
+	var events []*alertEvent
+	for id, a := range alerts {
+		if known[id] == nil {
+			events = append(events, p.event(a, time.Unix(a.OpenedAt, 0)))
+		}
+	}
+	for id, a := range known {
+		if alerts[id] != nil {
+			continue
+		}
+		closed, err := p.GetAlert(id)
+		if err != nil {
+			c := *a
+			c.Status = "OK"
+			closed = &c
+		}
+		t := time.Now()
+		if closed.ClosedAt != 0 {
+			t = time.Unix(closed.ClosedAt, 0)
+		}
+		events = append(events, p.event(closed, t))
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time.Before(events[j].time)
+	})
+	return events
+}
+
+// alertEvent is an alert opened or closed.
+type alertEvent struct {
+	time    time.Time
+	alert   *mackerel.Alert
+	monitor string // name of the monitor, or its ID if unknown
+	target  string // name of the host or the service, or empty
+
+	services map[string]bool // services the alert concerns
+	roles    map[string]bool // roles the alert concerns, as service:role
+}
+
+// event returns the event of a at t, with the monitor and the host or the
+// service of a.
+func (p *alertPoller) event(a *mackerel.Alert, t time.Time) *alertEvent {
+	e := &alertEvent{
+		time:     t,
+		alert:    a,
+		monitor:  a.MonitorID,
+		services: make(map[string]bool),
+		roles:    make(map[string]bool),
+	}
+	m := p.monitor(a.MonitorID)
+	if m != nil {
+		e.monitor = m.MonitorName()
+	}
+	if a.HostID != "" {
+		host, err := p.FindHost(a.HostID)
+		if err != nil {
+			e.target = a.HostID
+			return e
+		}
+		e.target = host.Name
+		for service, roles := range host.Roles {
+			e.services[service] = true
+			for _, role := range roles {
+				e.roles[service+":"+role] = true
+			}
+		}
+		return e
+	}
+	e.target = monitorService(m)
+	if e.target != "" {
+		e.services[e.target] = true
+	}
+	return e
+}
+
+// monitor returns the monitor of id, or nil if it is not found.
+func (p *alertPoller) monitor(id string) mackerel.Monitor {
+	p.monitorsMu.Lock()
+	defer p.monitorsMu.Unlock()
+	if m, ok := p.monitors[id]; ok {
+		return m
+	}
+	m, err := p.GetMonitor(id)
+	if err != nil {
+		if !errors.Is(fsError(err), fs.ErrNotExist) {
+			return nil // retry later
+		}
+		m = nil
+	}
+	if p.monitors == nil {
+		p.monitors = make(map[string]mackerel.Monitor)
+	}
+	p.monitors[id] = m
+	return m
+}
+
+// line returns the line describing e: the time, the status, the ID of the
+// alert, the monitor, the host or the service and the message, separated
+// by tabs.
+func (e *alertEvent) line() []byte {
+	field := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return strings.Join(strings.Fields(s), " ")
+	}
+	return []byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n",
+		e.time.UTC().Format(time.RFC3339),
+		field(e.alert.Status),
+		field(e.alert.ID),
+		field(e.monitor),
+		field(e.target),
+		field(e.alert.Message)))
+}
+
+// alertFilters is the VarFS of alerts/filters, whose directories are
+// made by reading the clone file. Each directory has the ctl file of an
+// alertFilter and the events file reading the events passed by it.
+type alertFilters struct {
+	events *feed[*alertEvent]
+
+	mu   sync.Mutex
+	m    map[string]fs.FS
+	next int // the number of the last filter made
+}
+
+func (a *alertFilters) All() (muxfs.Seq[string], error) {
+	a.mu.Lock()
+	names := sortedKeys(a.m)
+	a.mu.Unlock()
+	return func(yield func(string) bool) {
+		for _, name := range names {
+			if !yield(name) {
+				return
+			}
+		}
+	}, nil
+}
+
+func (a *alertFilters) FS(name string) (fs.FS, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, ok := a.m[name]
+	return f, ok
+}
+
+// add makes a filter and returns its name.
+func (a *alertFilters) add() string {
+	filter := &alertFilter{}
+	m := muxfs.NewFS()
+	m.File("ctl", muxfs.CtlFileUsage(alertFilterUsage, filter.command))
+	m.Pipe("events", muxfs.FuncFile(func(name string, flag int) (fs.File, error) {
+		return a.events.open(name, flag, filter)
+	}))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next++
+	name := strconv.Itoa(a.next)
+	a.m[name] = m
+	return name
+}
+
+func (a *alertFilters) remove(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.m, name)
+}
+
+// alertFilterClone is an open clone file of alerts/filters. The first
+// read makes a filter, so that stating the file does not, and the reads
+// return its name. Closing the file removes the filter.
+type alertFilterClone struct {
+	name    string
+	filters *alertFilters
+
+	mu     sync.Mutex
+	filter string // "" until read
+	off    int
+	closed bool
+}
+
+func (f *alertFilterClone) Stat() (fs.FileInfo, error) {
+	return muxfs.FileInfo(f.name, 0444, 0, time.Time{}), nil
+}
+
+func (f *alertFilterClone) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.filter == "" {
+		f.filter = f.filters.add()
+	}
+	line := f.filter + "\n"
+	if f.off >= len(line) {
+		return 0, io.EOF
+	}
+	n := copy(p, line[f.off:])
+	f.off += n
+	return n, nil
+}
+
+func (f *alertFilterClone) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed && f.filter != "" {
+		f.filters.remove(f.filter)
+	}
+	f.closed = true
+	return nil
+}
+
+const alertFilterUsage = `service name
+role service:role
+clear`
+
+// alertFilter selects the events of alerts by the services or the roles
+// of the alerts. The commands are:
+//
+//	service name       pass the alerts of the service
+//	role service:role  pass the alerts of the role
+//	clear              pass all the alerts, which is the default
+type alertFilter struct {
+	mu       sync.Mutex
+	services map[string]bool
+	roles    map[string]bool
+}
+
+func (f *alertFilter) match(e *alertEvent) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.services) == 0 && len(f.roles) == 0 {
+		return true
+	}
+	for s := range f.services {
+		if e.services[s] {
+			return true
+		}
+	}
+	for r := range f.roles {
+		if e.roles[r] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *alertFilter) command(s string) error {
+	args := strings.Fields(s)
+	if len(args) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch args[0] {
+	case "clear":
+		f.services, f.roles = nil, nil
+		return nil
+	case "service":
+		if len(args) != 2 {
+			return errors.New("usage: service name")
+		}
+		if f.services == nil {
+			f.services = make(map[string]bool)
+		}
+		f.services[args[1]] = true
+		return nil
+	case "role":
+		if len(args) != 2 || !strings.Contains(args[1], ":") {
+			return errors.New("usage: role service:role")
+		}
+		if f.roles == nil {
+			f.roles = make(map[string]bool)
+		}
+		f.roles[args[1]] = true
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
@@ -0,0 +1,310 @@
+package mackerelfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+// Limits bounds the API requests sent for each organization.
+// A zero field means the corresponding field of DefaultLimits.
+type Limits struct {
+	// Rate is the sustained number of requests per second.
+	Rate float64
+
+	// Burst is the number of requests which can be sent at once.
+	Burst int
+
+	// Concurrency is the maximum number of requests in flight.
+	Concurrency int
+
+	// Retries is the maximum number of retries of a request answered
+	// with 429 Too Many Requests or a 5xx status. A negative Retries
+	// disables retries.
+	Retries int
+
+	// Backoff is the wait before the first retry. It doubles on each retry.
+	Backoff time.Duration
+
+	// MaxBackoff is the longest wait before a retry. A request whose
+	// Retry-After is longer than MaxBackoff is not retried.
+	MaxBackoff time.Duration
+}
+
+// DefaultLimits are the limits used for zero fields of Limits.
+var DefaultLimits = Limits{
+	Rate:        5,
+	Burst:       10,
+	Concurrency: 4,
+	Retries:     4,
+	Backoff:     500 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.Rate == 0 {
+		l.Rate = DefaultLimits.Rate
+	}
+	if l.Burst == 0 {
+		l.Burst = DefaultLimits.Burst
+	}
+	if l.Concurrency == 0 {
+		l.Concurrency = DefaultLimits.Concurrency
+	}
+	if l.Retries == 0 {
+		l.Retries = DefaultLimits.Retries
+	}
+	if l.Backoff == 0 {
+		l.Backoff = DefaultLimits.Backoff
+	}
+	if l.MaxBackoff == 0 {
+		l.MaxBackoff = DefaultLimits.MaxBackoff
+	}
+	return l
+}
+
+// client is the Mackerel API client shared by all file systems of an
+// organization. Every request is sent through its sharedTransport and
+// then its limitTransport.
+type client struct {
+	*mackerel.Client
+	transport    *limitTransport
+	stats        *stats
+	readOnly     bool          // see Options.ReadOnly
+	pollInterval time.Duration // see Options.PollInterval
+	recent       recentAlertCache
+}
+
+func newOrgClient(c *mackerel.Client, l Limits) *client {
+	s := newStats()
+	t := newLimitTransport(c.HTTPClient.Transport, l, s)
+	c.HTTPClient.Transport = &sharedTransport{base: t, stats: s}
+	return &client{Client: c, transport: t, stats: s}
+}
+
+// writable returns fs.ErrPermission if the organization must not be
+// changed.
+func (c *client) writable() error {
+	if c.readOnly {
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// status returns the content of the status file of the organization.
+func (c *client) status(org string) []byte {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "org=%s\n", org)
+	fmt.Fprintf(b, "api=%s\n", c.BaseURL)
+	fmt.Fprintf(b, "apikey=%s\n", maskKey(c.APIKey))
+	c.stats.format(b)
+	t := c.transport
+	fmt.Fprintf(b, "ratelimit.rate=%g\n", t.limits.Rate)
+	fmt.Fprintf(b, "ratelimit.burst=%d\n", t.limits.Burst)
+	fmt.Fprintf(b, "ratelimit.tokens=%.2f\n", t.limiter.Tokens())
+	fmt.Fprintf(b, "inflight=%d\n", len(t.sem))
+	return b.Bytes()
+}
+
+// sharedTransport is an http.RoundTripper which coalesces concurrent
+// identical GET requests: only one of them is sent and all of them receive
+// a copy of its response.
+type sharedTransport struct {
+	base  http.RoundTripper
+	group singleflight.Group
+	stats *stats
+}
+
+type sharedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+func (t *sharedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+	key := req.Header.Get("X-Api-Key") + " " + req.URL.String()
+	v, err, shared := t.group.Do(key, func() (any, error) {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &sharedResponse{resp: resp, body: body}, nil
+	})
+	if shared {
+		t.stats.share()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := v.(*sharedResponse)
+	resp := *s.resp
+	resp.Header = s.resp.Header.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(s.body))
+	resp.Request = req
+	return &resp, nil
+}
+
+// limitTransport is an http.RoundTripper which sends requests at a limited
+// rate and concurrency, and retries them with exponential backoff.
+type limitTransport struct {
+	base    http.RoundTripper
+	limits  Limits
+	limiter *rate.Limiter
+	sem     chan struct{}
+	stats   *stats
+}
+
+func newLimitTransport(base http.RoundTripper, l Limits, s *stats) *limitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	l = l.withDefaults()
+	return &limitTransport{
+		base:    base,
+		limits:  l,
+		limiter: rate.NewLimiter(rate.Limit(l.Rate), l.Burst),
+		sem:     make(chan struct{}, l.Concurrency),
+		stats:   s,
+	}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := t.send(req)
+		if err != nil || !retryable(req, resp) || attempt >= t.limits.Retries {
+			return resp, err
+		}
+		wait, ok := t.backoff(attempt, resp)
+		if !ok {
+			return resp, nil
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+		req = req.Clone(ctx)
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// send sends req once the limiter and the semaphore allow. The semaphore is
+// held until the response body is closed.
+func (t *limitTransport) send(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if err := t.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	resp, err := t.base.RoundTrip(req)
+	t.stats.call(req, err != nil || resp.StatusCode >= 400)
+	if err != nil {
+		<-t.sem
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { <-t.sem }}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// retryable reports whether req answered with resp should be sent again.
+// A request refused for its rate is never processed, so it is always
+// retried; server errors are retried only for idempotent methods.
+func retryable(req *http.Request, resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode >= 500:
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the retry following attempt.
+// It reports false if Retry-After asks to wait longer than MaxBackoff.
+func (t *limitTransport) backoff(attempt int, resp *http.Response) (time.Duration, bool) {
+	if d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		return d, d <= t.limits.MaxBackoff
+	}
+	d := t.limits.Backoff << attempt
+	if d <= 0 || d > t.limits.MaxBackoff {
+		d = t.limits.MaxBackoff
+	}
+	// full jitter on the upper half
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)), true
+}
+
+// retryAfter parses the value of a Retry-After header, which is either
+// seconds or an HTTP date.
+func retryAfter(s string, now time.Time) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
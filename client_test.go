@@ -0,0 +1,112 @@
+package mackerelfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rmatsuoka/mackerelfs/internal/mackereltest"
+)
+
+func TestLimitTransportRetry(t *testing.T) {
+	srv := mackereltest.NewServer(testFixture())
+	defer srv.Close()
+	c := newOrgClient(srv.NewClient(), Limits{
+		Rate:       1e6,
+		Burst:      1e6,
+		Retries:    3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	})
+
+	srv.FailNext(3, http.StatusServiceUnavailable)
+	if _, err := c.GetOrg(); err != nil {
+		t.Errorf("GetOrg after 3 failures returns %v, want nil", err)
+	}
+
+	srv.FailNext(4, http.StatusTooManyRequests)
+	if _, err := c.GetOrg(); !errors.Is(fsError(err), ErrRateLimited) {
+		t.Errorf("GetOrg after 4 failures returns %v, want ErrRateLimited", err)
+	}
+}
+
+func TestLimitTransportRate(t *testing.T) {
+	srv := mackereltest.NewServer(testFixture())
+	defer srv.Close()
+	c := newOrgClient(srv.NewClient(), Limits{Rate: 50, Burst: 1})
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// distinct requests, which are not coalesced
+			c.FindHost(fmt.Sprint("host", i))
+		}(i)
+	}
+	wg.Wait()
+	// The first request is sent immediately and the rest every 20ms.
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("5 requests at 50/s take %v, want at least 80ms", d)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"Mon, 01 Jan 2024 00:00:05 GMT", 5 * time.Second, true},
+		{"Sun, 31 Dec 2023 23:59:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.s, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSharedTransport(t *testing.T) {
+	fsys, srv := newTestOrgFS(t, testFixture())
+	if _, err := fs.Stat(fsys, "service/web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "hosts/web01/metrics/loadavg5"); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetDelay(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fs.ReadDir(fsys, "service/web"); err != nil {
+				t.Error(err)
+			}
+			if _, err := fs.ReadFile(fsys, "hosts/web01/metrics/loadavg5/1hour"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := srv.Requests("GET", "/api/v0/services/web/roles"); n != 1 {
+		t.Errorf("roles are requested %d times, want 1", n)
+	}
+	if n := srv.Requests("GET", "/api/v0/hosts/host1/metrics"); n > 2 {
+		// Readers in different seconds ask different windows.
+		t.Errorf("metrics are requested %d times, want at most 2", n)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"9fans.net/go/plan9"
+
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
+	"github.com/rmatsuoka/ya9p"
+)
+
+// access is what a user may do on the file system.
+type access int
+
+const (
+	readOnly  access = iota + 1 // read files
+	readWrite                   // also write ctl and other files
+)
+
+// user is an entry of the users file.
+type user struct {
+	secret string // empty if the user authenticates only by certificate
+	access access
+}
+
+// readUsers reads the users file, whose lines are
+//
+//	name secret access
+//
+// where access is ro or rw, and secret is - for a user who authenticates
+// only by a client certificate. Empty lines and lines beginning with #
+// are ignored.
+func readUsers(r io.Reader) (map[string]user, error) {
+	users := make(map[string]user)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: want 3 fields, got %d", n, len(f))
+		}
+		var u user
+		if f[1] != "-" {
+			u.secret = f[1]
+		}
+		switch f[2] {
+		case "ro":
+			u.access = readOnly
+		case "rw":
+			u.access = readWrite
+		default:
+			return nil, fmt.Errorf("line %d: unknown access %q", n, f[2])
+		}
+		users[f[0]] = u
+	}
+	return users, s.Err()
+}
+
+func readUsersFile(name string) (map[string]user, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users, err := readUsers(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return users, nil
+}
+
+// authConfig is how attaches are authenticated. The zero authConfig
+// accepts every attach with full access.
+type authConfig struct {
+	// secret is the shared secret which grants full access.
+	secret string
+
+	// users is the allow-list of users. If non-nil, only these users
+	// can attach, with the secrets of the users; secret must be empty.
+	users map[string]user
+
+	// certs reports whether connections are authenticated by verified
+	// client certificates.
+	certs bool
+}
+
+func (c *authConfig) required() bool {
+	return c.secret != "" || c.users != nil || c.certs
+}
+
+// authSrv is the ya9p.Srv of a connection. A client presents its secret
+// either by writing it to the auth fid, or, for clients such as v9fs which
+// do not implement 9P authentication, as the attach name.
+type authSrv struct {
+	fsys fs.FS
+	conf *authConfig
+
+	// certUser is the common name of the verified client certificate of
+	// the connection, if any.
+	certUser string
+}
+
+func (s *authSrv) Auth(uname, aname string) (ya9p.Fid, ya9p.Qid, error) {
+	if !s.conf.required() {
+		return nil, ya9p.Qid{}, ya9p.NoAuthRequired
+	}
+	return &authFid{}, ya9p.Qid{Type: plan9.QTAUTH}, nil
+}
+
+func (s *authSrv) Attach(afid ya9p.Fid, uname, aname string) (ya9p.Fid, ya9p.Qid, error) {
+	secret := aname
+	if f, ok := afid.(*authFid); ok {
+		secret = f.secret()
+	}
+	a, err := s.access(uname, secret)
+	if err != nil {
+		return nil, ya9p.Qid{}, err
+	}
+	fsys := s.fsys
+	if a == readOnly {
+		fsys = extfs.ReadOnlyFS(fsys)
+	}
+	return newFid(fsys, ".")
+}
+
+// access returns the access of uname who presents secret.
+func (s *authSrv) access(uname, secret string) (access, error) {
+	c := s.conf
+	if !c.required() {
+		return readWrite, nil
+	}
+	if c.certs && s.certUser == "" {
+		return 0, ya9p.ErrAuth
+	}
+	if c.users != nil {
+		u, ok := c.users[uname]
+		if !ok {
+			return 0, ya9p.ErrAuth
+		}
+		// A verified certificate of the user stands for its secret.
+		if c.certs && s.certUser == uname {
+			return u.access, nil
+		}
+		if u.secret != "" && equal(secret, u.secret) {
+			return u.access, nil
+		}
+		return 0, ya9p.ErrAuth
+	}
+	if c.secret != "" && !equal(secret, c.secret) {
+		return 0, ya9p.ErrAuth
+	}
+	return readWrite, nil
+}
+
+func equal(s, t string) bool {
+	return subtle.ConstantTimeCompare([]byte(s), []byte(t)) == 1
+}
+
+// authFid is the auth fid to which a client writes its secret.
+type authFid struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (f *authFid) secret() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.TrimSpace(string(f.buf))
+}
+
+func (f *authFid) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off != int64(len(f.buf)) {
+		return 0, ya9p.ErrBadOffset
+	}
+	f.buf = append(f.buf, p...)
+	return len(p), nil
+}
+
+func (f *authFid) ReadAt(p []byte, off int64) (int, error) { return 0, io.EOF }
+func (f *authFid) Walk([]string) (ya9p.Fid, []ya9p.Qid, error) {
+	return nil, nil, ya9p.ErrWalkNoDir
+}
+func (f *authFid) Open(mode uint8) (ya9p.Qid, uint32, error) {
+	return ya9p.Qid{Type: plan9.QTAUTH}, 0, nil
+}
+func (f *authFid) Create(string, uint8, ya9p.Perm) (ya9p.Qid, uint32, error) {
+	return ya9p.Qid{}, 0, ya9p.ErrNoCreate
+}
+func (f *authFid) Clunk() error  { return nil }
+func (f *authFid) Remove() error { return ya9p.ErrNoRemove }
+func (f *authFid) Stat() (*ya9p.Dir, error) {
+	return &ya9p.Dir{Qid: ya9p.Qid{Type: plan9.QTAUTH}, Mode: plan9.DMAUTH | 0600, Name: "auth"}, nil
+}
+func (f *authFid) WStat(*ya9p.Dir) error { return ya9p.ErrNoWstat }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadUsers(t *testing.T) {
+	users, err := readUsers(strings.NewReader(`# name secret access
+alice s3cret rw
+
+bob - ro
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := users["alice"]; u.secret != "s3cret" || u.access != readWrite {
+		t.Errorf("alice is %+v", u)
+	}
+	if u := users["bob"]; u.secret != "" || u.access != readOnly {
+		t.Errorf("bob is %+v", u)
+	}
+	if _, err := readUsers(strings.NewReader("carol secret admin\n")); err == nil {
+		t.Error("unknown access is accepted")
+	}
+}
+
+func TestAccess(t *testing.T) {
+	users := map[string]user{
+		"alice": {secret: "s3cret", access: readWrite},
+		"bob":   {access: readOnly},
+	}
+	for _, tt := range []struct {
+		name     string
+		conf     authConfig
+		certUser string
+		uname    string
+		secret   string
+		want     access // 0 means refused
+	}{
+		{"no auth", authConfig{}, "", "anyone", "", readWrite},
+		{"shared secret", authConfig{secret: "x"}, "", "anyone", "x", readWrite},
+		{"wrong shared secret", authConfig{secret: "x"}, "", "anyone", "y", 0},
+		{"user secret", authConfig{users: users}, "", "alice", "s3cret", readWrite},
+		{"wrong user secret", authConfig{users: users}, "", "alice", "x", 0},
+		{"unknown user", authConfig{users: users}, "", "carol", "s3cret", 0},
+		{"no secret", authConfig{users: users}, "", "bob", "", 0},
+		{"certificate", authConfig{users: users, certs: true}, "bob", "bob", "", readOnly},
+		{"other's certificate", authConfig{users: users, certs: true}, "bob", "alice", "s3cret", readWrite},
+		{"no certificate", authConfig{users: users, certs: true}, "", "alice", "s3cret", 0},
+		{"certificate only", authConfig{certs: true}, "anyone", "anyone", "", readWrite},
+	} {
+		s := &authSrv{conf: &tt.conf, certUser: tt.certUser}
+		got, err := s.access(tt.uname, tt.secret)
+		if got != tt.want || (err == nil) != (tt.want != 0) {
+			t.Errorf("%s: access returns %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewAuthConfigExclusive(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	users := filepath.Join(dir, "users")
+	if err := os.WriteFile(secret, []byte("x\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(users, []byte("alice s3cret rw\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s, u string) { *secretFile, *usersFile = s, u }(*secretFile, *usersFile)
+	*secretFile, *usersFile = secret, users
+	if _, err := newAuthConfig(); err == nil {
+		t.Error("-secret-file and -users are accepted together")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	"9fans.net/go/plan9"
+	"github.com/rmatsuoka/ya9p"
+
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
+)
+
+// fid is a ya9p.Fid of a file system, which also makes directories by
+// create and removes files through extfs.Mkdir and extfs.Remove.
+// ya9p.FSFid refuses every create and remove.
+type fid struct {
+	ya9p.Fid
+	fsys fs.FS
+	name string // path in fsys
+}
+
+func newFid(fsys fs.FS, name string) (ya9p.Fid, ya9p.Qid, error) {
+	f, qid, err := ya9p.FSFid(fsys, name)
+	if err != nil {
+		return nil, qid, err
+	}
+	return &fid{Fid: f, fsys: fsys, name: name}, qid, nil
+}
+
+func (f *fid) Walk(names []string) (ya9p.Fid, []ya9p.Qid, error) {
+	nf, qids, err := f.Fid.Walk(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := f.name
+	for _, elem := range names[:len(qids)] {
+		name = join(name, elem)
+	}
+	return &fid{Fid: nf, fsys: f.fsys, name: name}, qids, nil
+}
+
+// join joins elem to dir as ya9p does: the parent of the root is the root.
+func join(dir, elem string) string {
+	name := path.Join(dir, elem)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "."
+	}
+	return name
+}
+
+func (f *fid) Create(name string, mode uint8, perm ya9p.Perm) (ya9p.Qid, uint32, error) {
+	if perm&plan9.DMDIR == 0 {
+		return f.Fid.Create(name, mode, perm)
+	}
+	dir := join(f.name, name)
+	if err := extfs.Mkdir(f.fsys, dir, fs.FileMode(perm&0777)); err != nil {
+		return ya9p.Qid{}, 0, err
+	}
+	nf, _, err := ya9p.FSFid(f.fsys, dir)
+	if err != nil {
+		return ya9p.Qid{}, 0, err
+	}
+	qid, iounit, err := nf.Open(mode)
+	if err != nil {
+		return ya9p.Qid{}, 0, err
+	}
+	// The fid represents the new directory after create.
+	f.Fid, f.name = nf, dir
+	return qid, iounit, nil
+}
+
+// Remove removes the file through extfs.Remove. The fid is clunked even
+// if the removal fails.
+func (f *fid) Remove() error {
+	err := extfs.Remove(f.fsys, f.name)
+	if cerr := f.Fid.Clunk(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"9fans.net/go/plan9"
+	"github.com/rmatsuoka/ya9p"
+
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
+)
+
+func TestFidCreate(t *testing.T) {
+	fsys := extfs.NewDirFS(0755)
+	root, _, err := newFid(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := root.Walk(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qid, _, err := f.Create("a", plan9.OREAD, plan9.DMDIR|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qid.Type&plan9.QTDIR == 0 {
+		t.Errorf("qid of the made directory is %+v", qid)
+	}
+	if info, err := fs.Stat(fsys, "a"); err != nil || !info.IsDir() {
+		t.Errorf("a is not made: %v", err)
+	}
+
+	a, qids, err := root.Walk([]string{"a"})
+	if err != nil || len(qids) != 1 {
+		t.Fatalf("walk to a: %v", err)
+	}
+	if _, _, err := a.Create("b", plan9.OREAD, plan9.DMDIR|0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "a/b"); err != nil {
+		t.Errorf("a/b is not made: %v", err)
+	}
+
+	f, _, _ = root.Walk(nil)
+	if _, _, err := f.Create("file", plan9.OWRITE, 0644); !errors.Is(err, ya9p.ErrNoCreate) {
+		t.Errorf("create of a file returns %v, want %v", err, ya9p.ErrNoCreate)
+	}
+}
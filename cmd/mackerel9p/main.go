@@ -1,29 +1,173 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
 	"log"
 	"net"
+	"os"
 
 	"github.com/rmatsuoka/mackerelfs"
+	"github.com/rmatsuoka/mackerelfs/internal/cmdutil"
 	"github.com/rmatsuoka/ya9p"
 )
 
+var (
+	addr     = flag.String("addr", "localhost:8000", "listen on `address`")
+	apiFlags = cmdutil.Register(flag.CommandLine)
+
+	tlsCert    = flag.String("tls-cert", "", "serve TLS with the certificate in `file`")
+	tlsKey     = flag.String("tls-key", "", "read the private key of -tls-cert from `file`")
+	clientCA   = flag.String("tls-client-ca", "", "require client certificates signed by the CAs in `file`")
+	secretFile = flag.String("secret-file", "", "require the shared secret in `file` to attach; exclusive with -users")
+	usersFile  = flag.String("users", "", "allow only the users listed in `file` to attach")
+	private    = flag.Bool("private", false, "give each connection its own set of organizations")
+	stateFile  = flag.String("state", "", "save registered organizations to `file` and restore them at startup")
+)
+
 func main() {
-	listener, err := net.Listen("tcp", "localhost:8000")
+	flag.Parse()
+
+	opts, err := apiFlags.Options()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *stateFile != "" {
+		if *private {
+			log.Fatal("-state and -private are mutually exclusive")
+		}
+		opts.StateFile = *stateFile
+	}
+	if *private {
+		// Connections registering the same API key still share the
+		// data fetched for the organization.
+		opts.Cache = mackerelfs.NewOrgCache()
+	}
+	newFS := func() (fs.FS, error) {
+		fsys := mackerelfs.NewFS(opts)
+		if err := apiFlags.RegisterReplay(fsys); err != nil {
+			return nil, err
+		}
+		return fsys, nil
+	}
+	var shared fs.FS
+	if !*private {
+		var err error
+		if shared, err = newFS(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
+	conf, err := newAuthConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConf, err := newTLSConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fsys := mackerelfs.FS()
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsConf != nil {
+		listener = tls.NewListener(listener, tlsConf)
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			log.Print(err)
+			continue
+		}
+		go func() {
+			fsys := shared
+			if fsys == nil {
+				own, err := newFS()
+				if err != nil {
+					log.Print(err)
+					conn.Close()
+					return
+				}
+				defer own.(io.Closer).Close()
+				fsys = own
+			}
+			serve(conn, &authSrv{fsys: fsys, conf: conf})
+		}()
+	}
+}
+
+// serve serves s on conn, once the TLS handshake, if any, is done.
+func serve(conn net.Conn, s *authSrv) {
+	if c, ok := conn.(*tls.Conn); ok {
+		if err := c.Handshake(); err != nil {
+			log.Printf("%s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+			s.certUser = certs[0].Subject.CommonName
+		}
+	}
+	ya9p.Serve(conn, s)
+}
+
+func newAuthConfig() (*authConfig, error) {
+	conf := &authConfig{certs: *clientCA != ""}
+	if *secretFile != "" && *usersFile != "" {
+		// The users file has the secrets of the users, so a shared
+		// secret would be ignored.
+		return nil, errors.New("-secret-file and -users are mutually exclusive")
+	}
+	if *secretFile != "" {
+		secret, err := cmdutil.ReadSecret(*secretFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.secret = secret
+	}
+	if *usersFile != "" {
+		users, err := readUsersFile(*usersFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.users = users
+	}
+	return conf, nil
+}
+
+// newTLSConfig returns the TLS configuration given by the flags, or nil if
+// TLS is not enabled.
+func newTLSConfig() (*tls.Config, error) {
+	if *tlsCert == "" && *tlsKey == "" {
+		if *clientCA != "" {
+			return nil, errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *clientCA != "" {
+		b, err := os.ReadFile(*clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New(*clientCA + ": no certificates")
 		}
-		go ya9p.Serve(conn, ya9p.FS(fsys))
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
 	}
+	return conf, nil
 }
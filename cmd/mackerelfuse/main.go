@@ -0,0 +1,87 @@
+//go:build linux
+
+// Mackerelfuse mounts the mackerelfs file system on a directory with FUSE.
+//
+// Usage:
+//
+//	mackerelfuse [flags] mountpoint
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rmatsuoka/mackerelfs"
+	"github.com/rmatsuoka/mackerelfs/internal/cmdutil"
+	"github.com/rmatsuoka/mackerelfs/internal/fusefs"
+)
+
+var (
+	apiFlags   = cmdutil.Register(flag.CommandLine)
+	allowOther = flag.Bool("allow-other", false, "allow other users to access the file system")
+	cacheTTL   = flag.Duration("ttl", time.Second, "let the kernel cache names and attributes for `duration`")
+	debug      = flag.Bool("debug", false, "log FUSE requests")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: mackerelfuse [flags] mountpoint\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts, err := apiFlags.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fsys := mackerelfs.NewFS(opts)
+	if err := apiFlags.RegisterReplay(fsys); err != nil {
+		log.Fatal(err)
+	}
+
+	srv, err := gofs.Mount(flag.Arg(0), fusefs.New(fsys, errno), &gofs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther: *allowOther,
+			FsName:     "mackerelfs",
+			Name:       "mackerelfs",
+			Debug:      *debug,
+		},
+		EntryTimeout:    cacheTTL,
+		AttrTimeout:     cacheTTL,
+		NegativeTimeout: cacheTTL,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		if err := srv.Unmount(); err != nil {
+			log.Print(err)
+		}
+	}()
+	srv.Wait()
+}
+
+// errno is fusefs.Errno which also reports rate limiting as EAGAIN.
+func errno(err error) syscall.Errno {
+	if errors.Is(err, mackerelfs.ErrRateLimited) {
+		return syscall.EAGAIN
+	}
+	return fusefs.Errno(err)
+}
@@ -0,0 +1,112 @@
+// Mackerelhttp serves the mackerelfs file system over HTTP.
+//
+// By default the tree is served read-only as by http.FileServer. With
+// -webdav it is served by a WebDAV handler instead. WebDAV accepts writes,
+// such as PUT to ctl files and DELETE retiring hosts, only with
+// -secret-file, which requires clients to authenticate by HTTP basic
+// authentication with the secret as the password; without it, WebDAV is
+// served read-only.
+//
+// If the environment variable MACKEREL_APIKEY is set, the organization of
+// the key is registered at startup.
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/rmatsuoka/mackerelfs"
+	"github.com/rmatsuoka/mackerelfs/internal/cmdutil"
+	"github.com/rmatsuoka/mackerelfs/internal/davfs"
+)
+
+var (
+	addr       = flag.String("addr", "localhost:8080", "listen on `address`")
+	useDAV     = flag.Bool("webdav", false, "serve WebDAV, allowing writes with -secret-file")
+	secretFile = flag.String("secret-file", "", "require HTTP basic authentication with the shared secret in `file` as the password")
+	apiFlags   = cmdutil.Register(flag.CommandLine)
+)
+
+func main() {
+	flag.Parse()
+
+	opts, err := apiFlags.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var secret string
+	if *secretFile != "" {
+		if secret, err = cmdutil.ReadSecret(*secretFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if secret == "" {
+		opts.ReadOnly = true
+	}
+	fsys := mackerelfs.NewFS(opts)
+
+	switch {
+	case apiFlags.Replaying():
+		if err := apiFlags.RegisterReplay(fsys); err != nil {
+			log.Fatal(err)
+		}
+	case os.Getenv("MACKEREL_APIKEY") != "":
+		if err := cmdutil.Ctl(fsys, "new "+os.Getenv("MACKEREL_APIKEY")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var h http.Handler
+	if *useDAV {
+		h = &webdav.Handler{
+			FileSystem: davfs.New(fsys),
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+				}
+			},
+		}
+		if secret == "" {
+			h = readOnly(h)
+		}
+	} else {
+		h = http.FileServer(http.FS(fsys))
+	}
+	if secret != "" {
+		h = basicAuth(secret, h)
+	}
+	log.Fatal(http.ListenAndServe(*addr, h))
+}
+
+// readOnly returns the handler passing only the requests which do not
+// change anything to h.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			h.ServeHTTP(w, r)
+		default:
+			http.Error(w, "read-only without -secret-file", http.StatusForbidden)
+		}
+	})
+}
+
+// basicAuth returns the handler passing to h only the requests which
+// authenticate by HTTP basic authentication with secret as the password.
+func basicAuth(secret string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mackerelfs"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	h := readOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for method, want := range map[string]int{
+		http.MethodGet:    http.StatusOK,
+		"PROPFIND":        http.StatusOK,
+		http.MethodPut:    http.StatusForbidden,
+		http.MethodDelete: http.StatusForbidden,
+		"MKCOL":           http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/ctl", nil))
+		if w.Code != want {
+			t.Errorf("%s returns %d, want %d", method, w.Code, want)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := basicAuth("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		password string
+		want     int
+	}{
+		{"s3cret", http.StatusOK},
+		{"wrong", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/ctl", nil)
+		if tt.password != "" {
+			r.SetBasicAuth("user", tt.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("password %q returns %d, want %d", tt.password, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package mackerelfs
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// ErrRateLimited is reported when the Mackerel API refuses a request because
+// too many requests have been sent.
+var ErrRateLimited = errors.New("rate limited")
+
+// apiError is an error returned by the Mackerel API, classified as one of
+// the errors of io/fs or ErrRateLimited.
+type apiError struct {
+	kind error
+	err  *mackerel.APIError
+}
+
+func (e *apiError) Error() string {
+	if e.err.Message == "" {
+		return e.kind.Error()
+	}
+	return e.kind.Error() + ": " + e.err.Message
+}
+
+func (e *apiError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// fsError translates err returned by the Mackerel API so that callers can
+// test it with errors.Is against fs.ErrNotExist, fs.ErrPermission,
+// fs.ErrInvalid and ErrRateLimited. Other errors are returned as is.
+func fsError(err error) error {
+	var apiErr *mackerel.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	var kind error
+	switch apiErr.StatusCode {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		kind = fs.ErrInvalid
+	case http.StatusUnauthorized, http.StatusForbidden:
+		kind = fs.ErrPermission
+	case http.StatusNotFound:
+		kind = fs.ErrNotExist
+	case http.StatusTooManyRequests:
+		kind = ErrRateLimited
+	default:
+		return err
+	}
+	return &apiError{kind: kind, err: apiErr}
+}
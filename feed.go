@@ -0,0 +1,191 @@
+package mackerelfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
+)
+
+// DefaultPollInterval is the interval of polling the API for the feeds,
+// such as alerts/events, used if Options.PollInterval is zero.
+const DefaultPollInterval = time.Minute
+
+// maxQueuedEvents is the number of events kept for a reader of a feed.
+// The oldest events are dropped if the reader is slower.
+const maxQueuedEvents = 1024
+
+// feed sends events to the files reading it. run is started when a file
+// starts reading the feed, and stop is closed when no file reads it.
+type feed[E interface{ line() []byte }] struct {
+	run func(stop <-chan struct{})
+
+	mu   sync.Mutex
+	subs map[*feedFile[E]]bool
+	stop chan struct{} // nil if run is not running
+}
+
+func newFeed[E interface{ line() []byte }](run func(stop <-chan struct{})) *feed[E] {
+	return &feed[E]{run: run, subs: make(map[*feedFile[E]]bool)}
+}
+
+// open returns a file of the feed opened with flag, which must be
+// read-only. filter, if non-nil, selects the events read from the file.
+func (fd *feed[E]) open(name string, flag int, filter feedFilter[E]) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return &feedFile[E]{
+		name:   name,
+		feed:   fd,
+		filter: filter,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// subscribe sends the events to f from now on, and starts run if it is
+// not running. It does nothing if f is closed.
+func (fd *feed[E]) subscribe(f *feedFile[E]) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if closed {
+		return
+	}
+	fd.subs[f] = true
+	if fd.stop == nil {
+		fd.stop = make(chan struct{})
+		go fd.run(fd.stop)
+	}
+}
+
+// unsubscribe stops sending the events to f, and stops run if no file
+// is subscribed.
+func (fd *feed[E]) unsubscribe(f *feedFile[E]) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	delete(fd.subs, f)
+	if len(fd.subs) == 0 && fd.stop != nil {
+		close(fd.stop)
+		fd.stop = nil
+	}
+}
+
+// send sends events to the subscribed files.
+func (fd *feed[E]) send(events []E) {
+	if len(events) == 0 {
+		return
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	for f := range fd.subs {
+		for _, e := range events {
+			f.push(e)
+		}
+	}
+}
+
+// interval returns the interval of polling the API for the feeds.
+func (c *client) interval() time.Duration {
+	if c.pollInterval == 0 {
+		return DefaultPollInterval
+	}
+	return c.pollInterval
+}
+
+// feedFilter selects the events read from a feedFile. It is shared by the
+// files opened with it, so match may be called concurrently.
+type feedFilter[E any] interface {
+	match(e E) bool
+}
+
+// feedFile is an open file of a feed. Reading it blocks until an event
+// is sent, and returns the line of the event. The events are those sent
+// since the first read, so that stating the file does not start the feed.
+// It is a named pipe, so that recursive readers skip it.
+type feedFile[E interface{ line() []byte }] struct {
+	name   string
+	feed   *feed[E]
+	filter feedFilter[E] // nil if all events are read
+	sub    sync.Once     // subscribes f to feed on the first read
+	notify chan struct{} // receives when queue becomes non-empty
+	done   chan struct{} // closed by Close
+
+	mu     sync.Mutex
+	queue  [][]byte // lines not yet read; the first may be partly read
+	closed bool
+}
+
+func (f *feedFile[E]) Stat() (fs.FileInfo, error) {
+	return muxfs.FileInfo(f.name, fs.ModeNamedPipe|0444, 0, time.Time{}), nil
+}
+
+func (f *feedFile[E]) push(e E) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.filter != nil && !f.filter.match(e) {
+		return
+	}
+	if len(f.queue) >= maxQueuedEvents {
+		f.queue = f.queue[1:]
+	}
+	f.queue = append(f.queue, e.line())
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (f *feedFile[E]) Read(p []byte) (int, error) {
+	return f.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read but returns ctx.Err() if ctx is done before an
+// event arrives.
+func (f *feedFile[E]) ReadContext(ctx context.Context, p []byte) (int, error) {
+	f.sub.Do(func() { f.feed.subscribe(f) })
+	for {
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+		}
+		if len(f.queue) > 0 {
+			n := copy(p, f.queue[0])
+			if n < len(f.queue[0]) {
+				f.queue[0] = f.queue[0][n:]
+			} else {
+				f.queue = f.queue[1:]
+			}
+			f.mu.Unlock()
+			return n, nil
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-f.notify:
+		case <-f.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (f *feedFile[E]) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	f.mu.Unlock()
+	f.feed.unsubscribe(f)
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package mackerelfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/rmatsuoka/mackerelfs/internal/fusefs"
+)
+
+// TestFUSERemoveAll tests that removing a directory recursively retires
+// a host and deletes a monitor and an annotation.
+func TestFUSERemoveAll(t *testing.T) {
+	fixture := testFixture()
+	now := time.Now().Unix()
+	fixture.Monitors = []mackerel.Monitor{
+		&mackerel.MonitorConnectivity{ID: "mon1", Name: "connectivity", Type: "connectivity"},
+	}
+	fixture.GraphAnnotations = []*mackerel.GraphAnnotation{
+		{ID: "ann1", Title: "deploy", Service: "web", From: now - 600, To: now - 300},
+	}
+	fsys, srv := newTestOrgFS(t, fixture)
+	dir := t.TempDir()
+	fuseSrv, err := gofs.Mount(dir, fusefs.New(fsys, nil), &gofs.Options{
+		MountOptions: fuse.MountOptions{DirectMount: true},
+	})
+	if err != nil {
+		t.Skipf("cannot mount FUSE: %v", err)
+	}
+	t.Cleanup(func() { fuseSrv.Unmount() })
+
+	if err := os.RemoveAll(filepath.Join(dir, "hosts/db01")); err != nil {
+		t.Errorf("RemoveAll(hosts/db01): %v", err)
+	}
+	for _, name := range []string{"hosts/web01", "monitors/mon1", "service/web/annotations/ann1"} {
+		if err := removeTree(filepath.Join(dir, name)); err != nil {
+			t.Errorf("remove %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"hosts/db01", "hosts/web01", "monitors/mon1", "service/web/annotations/ann1"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s exists after removal: %v", name, err)
+		}
+	}
+	for _, req := range [][2]string{
+		{"POST", "/api/v0/hosts/host1/retire"},
+		{"POST", "/api/v0/hosts/host2/retire"},
+		{"DELETE", "/api/v0/monitors/mon1"},
+		{"DELETE", "/api/v0/graph-annotations/ann1"},
+	} {
+		if n := srv.Requests(req[0], req[1]); n != 1 {
+			t.Errorf("%s %s is requested %d times, want 1", req[0], req[1], n)
+		}
+	}
+}
+
+// removeTree removes the files in dir before dir itself, as rm -r does.
+// os.RemoveAll tries to remove dir first and so does not remove the files
+// if it succeeds.
+func removeTree(dir string) error {
+	var names []string
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		names = append(names, name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := os.Remove(names[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
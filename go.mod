@@ -3,8 +3,13 @@ module github.com/rmatsuoka/mackerelfs
 go 1.21.5
 
 require (
+	9fans.net/go v0.0.4
+	github.com/hanwen/go-fuse/v2 v2.9.0
 	github.com/mackerelio/mackerel-client-go v0.29.0
 	github.com/rmatsuoka/ya9p v0.0.0-20220503084806-5ef25d18730f
+	golang.org/x/net v0.35.0
+	golang.org/x/sync v0.10.0
+	golang.org/x/time v0.10.0
 )
 
-require 9fans.net/go v0.0.4 // indirect
+require golang.org/x/sys v0.30.0 // indirect
@@ -3,43 +3,380 @@ package mackerelfs
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mackerelio/mackerel-client-go"
 
 	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
 )
 
-func hostsFS(client *mackerel.Client) fs.FS {
+// hostsFS returns the file system of the hosts of an organization. Hosts
+// are listed by name, and by ID in the by-id directory. The hosts having
+// the same name, or a name of the other files such as ctl, are listed as
+// name@id. The by-status and by-service
+// directories list the hosts filtered by the API. Making a directory
+// registers a host of the name, and removing one retires the host.
+// Reading the changes file reloads the hosts periodically and returns the
+// changes found by each reload.
+func hostsFS(c *client, dir string) fs.FS {
 	m := muxfs.NewFS()
-	h := &hosts{Client: client, host: make(map[string]*hostFS)}
-	m.VarFS(h)
-	m.File("ctl", muxfs.CtlFile(func(s string) error {
+	h := &hosts{client: c, dir: dir}
+	h.changes = newFeed[*hostChange](h.run)
+	m.VarFS(&hostView{hosts: h, byID: false})
+	m.ModTime(h.modTime)
+	m.File("ctl", muxfs.CtlFileUsage("reload", func(s string) error {
 		if s != "" {
 			return h.reload()
 		}
 		return nil
 	}))
+	byID := muxfs.NewFS()
+	byID.VarFS(&hostView{hosts: h, byID: true})
+	byID.ModTime(h.modTime)
+	m.FS("by-id", byID)
+	byStatus, statusViews := hostsByStatusFS(c, path.Join(dir, "by-status"))
+	byService, serviceView := hostsByServiceFS(c, path.Join(dir, "by-service"))
+	h.views = append(statusViews, serviceView)
+	m.FS("by-status", byStatus)
+	m.FS("by-service", byService)
+	m.Pipe("changes", muxfs.FuncFile(func(name string, flag int) (fs.File, error) {
+		return h.changes.open(name, flag, nil)
+	}))
 	return m
 }
 
+var hostStatuses = []string{
+	mackerel.HostStatusWorking,
+	mackerel.HostStatusStandby,
+	mackerel.HostStatusMaintenance,
+	mackerel.HostStatusPoweroff,
+}
+
+// hostsByStatusFS returns the file system of the hosts by status and the
+// VarFS of each status.
+func hostsByStatusFS(c *client, dir string) (fs.FS, []*itemVarFS) {
+	m := muxfs.NewFS()
+	var views []*itemVarFS
+	for _, status := range hostStatuses {
+		fsys, varFS := newItemFS(c, path.Join(dir, status), findHosts(c, path.Join(dir, status), &mackerel.FindHostsParam{
+			Statuses: []string{status},
+		}))
+		m.FS(status, fsys)
+		views = append(views, varFS)
+	}
+	return m, views
+}
+
+// hostsByServiceFS returns the file system of the hosts by service and
+// role, and its VarFS. Since the directories of the services are loaded
+// by the VarFS, invalidating it discards the hosts of the roles as well.
+func hostsByServiceFS(c *client, dir string) (fs.FS, *itemVarFS) {
+	return newItemFS(c, dir, func() (Seq2[string, fs.FS], error) {
+		services, err := c.FindServices()
+		return func(yield func(string, fs.FS) bool) {
+			for _, v := range services {
+				if !yield(v.Name, hostsByRoleFS(c, path.Join(dir, v.Name), v.Name)) {
+					return
+				}
+			}
+		}, err
+	})
+}
+
+func hostsByRoleFS(c *client, dir, serviceName string) fs.FS {
+	return itemFS(c, dir, func() (Seq2[string, fs.FS], error) {
+		roles, err := c.FindRoles(serviceName)
+		return func(yield func(string, fs.FS) bool) {
+			for _, r := range roles {
+				dir := path.Join(dir, r.Name)
+				if !yield(r.Name, itemFS(c, dir, findHosts(c, dir, &mackerel.FindHostsParam{
+					Service: serviceName,
+					Roles:   []string{r.Name},
+				}))) {
+					return
+				}
+			}
+		}, err
+	})
+}
+
+// findHosts returns the fetch function of itemFS listing the hosts found
+// by param.
+func findHosts(c *client, dir string, param *mackerel.FindHostsParam) func() (Seq2[string, fs.FS], error) {
+	return func() (Seq2[string, fs.FS], error) {
+		hosts, err := c.FindHosts(param)
+		return func(yield func(string, fs.FS) bool) {
+			for i, name := range hostNames(hosts) {
+				if !yield(name, newHostFS(c, path.Join(dir, name), hosts[i])) {
+					return
+				}
+			}
+		}, err
+	}
+}
+
 type hosts struct {
-	host map[string]*hostFS
-	*mackerel.Client
+	*client
+	dir     string
+	changes *feed[*hostChange]
+	views   []*itemVarFS // by-status and by-service; see invalidateViews
+
+	// loadMu serializes load across the fetch, so that an older fetch
+	// never replaces the index of a newer one.
+	loadMu sync.Mutex
+
+	mu     sync.Mutex
+	index  *hostIndex // nil until loaded; never modified once set
+	loaded time.Time
+}
+
+// hostIndex is the loaded hosts.
+type hostIndex struct {
+	byName map[string]*hostFS // by unique name; see hostNames
+	byID   map[string]*hostFS
+}
+
+// unchanged returns the loaded file system of host if it is in dir and
+// host is unchanged, or nil. index may be nil.
+func (index *hostIndex) unchanged(dir string, host *mackerel.Host) *hostFS {
+	if index == nil {
+		return nil
+	}
+	fsys, ok := index.byID[host.ID]
+	if !ok || fsys.dir != dir || !reflect.DeepEqual(fsys.host, host) {
+		return nil
+	}
+	return fsys
 }
 
 type hostFS struct {
-	fsys fs.FS
-	id   string
+	fsys      fs.FS
+	id        string
+	name      string
+	status    string
+	createdAt time.Time
+	dir       string         // the directory of fsys
+	host      *mackerel.Host // the host fsys is made of
+}
+
+func (h *hosts) modTime() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.loaded
+}
+
+// hostIndex returns the loaded hosts, loading them if they are not yet.
+func (h *hosts) hostIndex() (*hostIndex, error) {
+	h.mu.Lock()
+	index := h.index
+	h.mu.Unlock()
+	h.stats.cache(index != nil)
+	if index != nil {
+		return index, nil
+	}
+	h.loadMu.Lock()
+	defer h.loadMu.Unlock()
+	// Another load may have finished while waiting for loadMu.
+	h.mu.Lock()
+	index = h.index
+	h.mu.Unlock()
+	if index != nil {
+		return index, nil
+	}
+	return h.loadLocked()
+}
+
+func (h *hosts) reload() error {
+	_, err := h.load()
+	return err
 }
 
-func (h *hosts) All() (muxfs.Seq[string], error) {
-	if len(h.host) == 0 {
-		return nil, h.reload()
+// invalidateViews discards the hosts loaded in by-status and by-service,
+// which a registered or retired host changes.
+func (h *hosts) invalidateViews() {
+	for _, v := range h.views {
+		v.invalidate()
 	}
+}
+
+func (h *hosts) load() (*hostIndex, error) {
+	h.loadMu.Lock()
+	defer h.loadMu.Unlock()
+	return h.loadLocked()
+}
+
+// loadLocked fetches the hosts and replaces the index. The file systems
+// of the hosts unchanged since the previous load are kept, so that their
+// loaded files are not fetched again. h.loadMu must be held.
+func (h *hosts) loadLocked() (*hostIndex, error) {
+	hosts, err := h.FindHosts(&mackerel.FindHostsParam{})
+	if err != nil {
+		return nil, fsError(err)
+	}
+	h.mu.Lock()
+	prev := h.index
+	h.mu.Unlock()
+	index := &hostIndex{
+		byName: make(map[string]*hostFS),
+		byID:   make(map[string]*hostFS),
+	}
+	for i, name := range hostNames(hosts) {
+		host := hosts[i]
+		dir := path.Join(h.dir, name)
+		fsys := prev.unchanged(dir, host)
+		if fsys == nil {
+			fsys = &hostFS{
+				id:        host.ID,
+				fsys:      newHostFS(h.client, dir, host),
+				name:      host.Name,
+				status:    host.Status,
+				createdAt: host.DateFromCreatedAt(),
+				dir:       dir,
+				host:      host,
+			}
+		}
+		index.byName[name] = fsys
+		index.byID[host.ID] = fsys
+	}
+
+	h.mu.Lock()
+	h.index = index
+	h.loaded = time.Now()
+	h.stats.reload(h.dir, h.loaded)
+	h.mu.Unlock()
+	if prev != nil {
+		h.changes.send(hostChanges(prev, index))
+	}
+	return index, nil
+}
+
+// run reloads the hosts periodically until stop is closed.
+func (h *hosts) run(stop <-chan struct{}) {
+	t := time.NewTicker(h.interval())
+	defer t.Stop()
+	for {
+		h.reload() // a failed reload is retried on the next tick
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// hostChange is a change of a host found by a reload.
+type hostChange struct {
+	op     byte // '+' if added, '-' if retired, '~' if changed
+	name   string
+	detail string
+}
+
+func (c *hostChange) line() []byte {
+	if c.detail == "" {
+		return []byte(fmt.Sprintf("%c %s\n", c.op, c.name))
+	}
+	return []byte(fmt.Sprintf("%c %s %s\n", c.op, c.name, c.detail))
+}
+
+// hostChanges returns the changes from prev to index, in order of the
+// host names.
+func hostChanges(prev, index *hostIndex) []*hostChange {
+	var changes []*hostChange
+	for id, host := range index.byID {
+		old, ok := prev.byID[id]
+		if !ok {
+			changes = append(changes, &hostChange{op: '+', name: host.name})
+			continue
+		}
+		if old.name != host.name {
+			changes = append(changes, &hostChange{op: '~', name: host.name, detail: "name " + old.name + "->" + host.name})
+		}
+		if old.status != host.status {
+			changes = append(changes, &hostChange{op: '~', name: host.name, detail: "status " + old.status + "->" + host.status})
+		}
+	}
+	for id, old := range prev.byID {
+		if _, ok := index.byID[id]; !ok {
+			changes = append(changes, &hostChange{op: '-', name: old.name, detail: "retired"})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].name < changes[j].name
+	})
+	return changes
+}
+
+// reservedHostNames are the names of the files listed together with
+// hosts, such as in hosts and in the directories of roles.
+var reservedHostNames = map[string]bool{
+	"ctl":        true,
+	"memo":       true,
+	"by-id":      true,
+	"by-status":  true,
+	"by-service": true,
+	"changes":    true,
+}
+
+// hostNames returns the directory names of hosts: the host name, or
+// name@id if other hosts have the same name or the name is reserved for
+// another file.
+func hostNames(hosts []*mackerel.Host) []string {
+	count := make(map[string]int)
+	for _, host := range hosts {
+		count[host.Name]++
+	}
+	names := make([]string, len(hosts))
+	for i, host := range hosts {
+		names[i] = host.Name
+		if count[host.Name] > 1 || reservedHostNames[host.Name] {
+			names[i] += "@" + host.ID
+		}
+	}
+	return names
+}
+
+// hostView is the VarFS of hosts listed by name or by ID.
+type hostView struct {
+	*hosts
+	byID bool
+}
+
+var (
+	_ muxfs.StatVarFS   = &hostView{}
+	_ muxfs.MkdirVarFS  = &hostView{}
+	_ muxfs.RemoveVarFS = &hostView{}
+)
+
+func (v *hostView) hostMap() (map[string]*hostFS, error) {
+	index, err := v.hostIndex()
+	if err != nil {
+		return nil, err
+	}
+	if v.byID {
+		return index.byID, nil
+	}
+	return index.byName, nil
+}
+
+func (v *hostView) All() (muxfs.Seq[string], error) {
+	m, err := v.hostMap()
+	if err != nil {
+		return nil, err
+	}
+	names := sortedKeys(m)
 	return func(yield func(string) bool) {
-		for k := range h.host {
+		for _, k := range names {
 			if !yield(k) {
 				return
 			}
@@ -47,62 +384,248 @@ func (h *hosts) All() (muxfs.Seq[string], error) {
 	}, nil
 }
 
-func (h *hosts) FS(name string) (fs.FS, bool) {
-	if len(h.host) == 0 {
-		h.reload()
-	}
-	fsys, ok := h.host[name]
+func (v *hostView) FS(name string) (fs.FS, bool) {
+	m, _ := v.hostMap()
+	fsys, ok := m[name]
 	if !ok {
 		return nil, false
 	}
 	return fsys.fsys, true
 }
 
-func (h *hosts) reload() error {
-	hosts, err := h.FindHosts(&mackerel.FindHostsParam{})
+// Mkdir registers a host named name. Hosts cannot be made in by-id, since
+// their IDs are given by Mackerel.
+func (v *hostView) Mkdir(name string, perm fs.FileMode) error {
+	if err := v.writable(); err != nil {
+		return err
+	}
+	if v.byID {
+		return fs.ErrPermission
+	}
+	if _, err := v.CreateHost(&mackerel.CreateHostParam{Name: name}); err != nil {
+		return fsError(err)
+	}
+	v.invalidateViews()
+	return v.reload()
+}
+
+// Remove retires the host.
+func (v *hostView) Remove(name string) error {
+	if err := v.writable(); err != nil {
+		return err
+	}
+	m, err := v.hostMap()
 	if err != nil {
 		return err
 	}
-	clear(h.host)
-	for _, host := range hosts {
-		h.host[host.Name] = &hostFS{
-			id:   host.ID,
-			fsys: newHostFS(h.Client, host.ID),
+	fsys, ok := m[name]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if err := v.RetireHost(fsys.id); err != nil {
+		return fsError(err)
+	}
+	v.invalidateViews()
+	return v.reload()
+}
+
+func (v *hostView) Stat(name string) (fs.FileInfo, error) {
+	m, err := v.hostMap()
+	if err != nil {
+		return nil, err
+	}
+	fsys, ok := m[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return muxfs.DirInfo(name, fsys.createdAt), nil
+}
+
+// hostFields are the files of a host showing a field of its info.
+var hostFields = []struct {
+	name   string
+	format func(b *bytes.Buffer, v *hostDetail)
+}{
+	{"name", func(b *bytes.Buffer, v *hostDetail) { line(b, v.Name) }},
+	{"displayName", func(b *bytes.Buffer, v *hostDetail) { line(b, v.DisplayName) }},
+	{"status", func(b *bytes.Buffer, v *hostDetail) { line(b, v.Status) }},
+	{"memo", func(b *bytes.Buffer, v *hostDetail) { line(b, v.Memo) }},
+	{"roles", func(b *bytes.Buffer, v *hostDetail) {
+		names := v.GetRoleFullnames()
+		sort.Strings(names)
+		for _, name := range names {
+			line(b, name)
 		}
+	}},
+	{"ipaddrs", func(b *bytes.Buffer, v *hostDetail) {
+		for _, i := range v.Interfaces {
+			addrs := append(append([]string(nil), i.IPv4Addresses...), i.IPv6Addresses...)
+			if len(addrs) == 0 && i.IPAddress != "" {
+				addrs = []string{i.IPAddress}
+			}
+			for _, addr := range addrs {
+				fmt.Fprintf(b, "%s\t%s\n", i.Name, addr)
+			}
+		}
+	}},
+	{"createdAt", func(b *bytes.Buffer, v *hostDetail) { timeLine(b, int64(v.CreatedAt)) }},
+	{"retiredAt", func(b *bytes.Buffer, v *hostDetail) { timeLine(b, v.RetiredAt) }},
+	{"agentVersion", func(b *bytes.Buffer, v *hostDetail) { line(b, v.Meta.AgentVersion) }},
+	{"kernel", func(b *bytes.Buffer, v *hostDetail) { keyValues(b, "", v.Meta.Kernel) }},
+	{"cpu", func(b *bytes.Buffer, v *hostDetail) {
+		for i, cpu := range v.Meta.CPU {
+			m := make(map[string]string)
+			for k, v := range cpu {
+				m[k] = fmt.Sprint(v)
+			}
+			keyValues(b, strconv.Itoa(i)+".", m)
+		}
+	}},
+	{"memory", func(b *bytes.Buffer, v *hostDetail) { keyValues(b, "", v.Meta.Memory) }},
+	{"meta", func(b *bytes.Buffer, v *hostDetail) {
+		enc := json.NewEncoder(b)
+		enc.SetIndent("", "  ")
+		enc.Encode(v.Meta)
+	}},
+}
+
+// hostUpdates are the functions updating the host with the content
+// written to the files of hostFields. The files not listed are read-only.
+var hostUpdates = map[string]func(h *host, v *hostDetail, b []byte) error{
+	"roles": func(h *host, v *hostDetail, b []byte) error {
+		return h.UpdateHostRoleFullnames(v.ID, strings.Fields(string(b)))
+	},
+	"meta": func(h *host, v *hostDetail, b []byte) error {
+		var meta mackerel.HostMeta
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return fmt.Errorf("%w: %v", fs.ErrInvalid, err)
+		}
+		// UpdateHost replaces the host, so pass the current fields.
+		_, err := h.UpdateHost(v.ID, &mackerel.UpdateHostParam{
+			Name:             v.Name,
+			DisplayName:      v.DisplayName,
+			Memo:             v.Memo,
+			Meta:             meta,
+			Interfaces:       v.Interfaces,
+			RoleFullnames:    v.GetRoleFullnames(),
+			CustomIdentifier: v.CustomIdentifier,
+		})
+		return err
+	},
+}
+
+// line writes s as a line, or nothing if s is empty.
+func line(b *bytes.Buffer, s string) {
+	if s == "" {
+		return
 	}
-	return nil
+	b.WriteString(s)
+	if !strings.HasSuffix(s, "\n") {
+		b.WriteByte('\n')
+	}
+}
+
+// timeLine writes the Unix time t as a line, or nothing if t is zero.
+func timeLine(b *bytes.Buffer, t int64) {
+	if t == 0 {
+		return
+	}
+	line(b, time.Unix(t, 0).UTC().Format(time.RFC3339))
 }
 
-func newHostFS(client *mackerel.Client, id string) fs.FS {
+// keyValues writes m as key=value lines sorted by key.
+func keyValues(b *bytes.Buffer, prefix string, m map[string]string) {
+	for _, k := range sortedKeys(m) {
+		fmt.Fprintf(b, "%s%s=%s\n", prefix, k, m[k])
+	}
+}
+
+func newHostFS(c *client, dir string, v *mackerel.Host) fs.FS {
+	id := v.ID
 	fsys := muxfs.NewFS()
-	h := &host{Client: client, id: id}
-	fsys.File("info", muxfs.ReaderFile(func() (io.Reader, error) {
-		var err error
-		if len(h.info) == 0 {
-			err = h.reload()
+	fsys.IgnoreRemove() // removed as a whole by hostView
+	h := &host{client: c, dir: dir, id: id}
+	createdAt := v.DateFromCreatedAt()
+	fsys.ModTime(func() time.Time { return createdAt })
+	fsys.File("id", muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+		return strings.NewReader(id + "\n"), createdAt, nil
+	}))
+	fsys.File("info", muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+		v, loaded, err := h.get()
+		if err != nil {
+			return nil, time.Time{}, err
 		}
-		return bytes.NewReader(h.info), err
+		return bytes.NewReader(v.info), loaded, nil
 	}))
-	fsys.File("ctl", muxfs.CtlFile(func(s string) error {
+	for _, field := range hostFields {
+		format := field.format
+		read := func() (io.Reader, time.Time, error) {
+			v, loaded, err := h.get()
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			b := new(bytes.Buffer)
+			format(b, v.host)
+			return bytes.NewReader(b.Bytes()), loaded, nil
+		}
+		update, ok := hostUpdates[field.name]
+		if !ok {
+			fsys.File(field.name, muxfs.ModReaderFile(read))
+			continue
+		}
+		fsys.File(field.name, muxfs.WritableFile(read, func(b []byte) error {
+			return h.update(update, b)
+		}))
+	}
+	fsys.File("ctl", muxfs.CtlFileUsage("reload", func(s string) error {
 		if s != "" {
 			return h.reload()
 		}
 		return nil
 	}))
-	fsys.FS("metrics", metricFS(hostMetrics{id: id, Client: client}))
+	fsys.FS("meta-system", &hostMetaFS{h: h})
+	fsys.FS("alerts", hostAlertsFS(c, path.Join(dir, "alerts"), id))
+	fsys.FS("metrics", metricFS(c, path.Join(dir, "metrics"), hostMetrics{id: id, client: c}))
 	return fsys
 }
 
 type host struct {
-	*mackerel.Client
-	id   string
+	*client
+	dir string
+	id  string
+
+	mu     sync.Mutex
+	v      *loadedHost // nil until loaded
+	loaded time.Time
+}
+
+// loadedHost is the fetched host and its info file.
+type loadedHost struct {
+	host *hostDetail
 	info []byte
 }
 
+// get returns the host, loading it if it is not yet.
+func (h *host) get() (*loadedHost, time.Time, error) {
+	h.mu.Lock()
+	v, loaded := h.v, h.loaded
+	h.mu.Unlock()
+	h.stats.cache(v != nil)
+	if v != nil {
+		return v, loaded, nil
+	}
+	if err := h.reload(); err != nil {
+		return nil, time.Time{}, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.v, h.loaded, nil
+}
+
 func (h *host) reload() error {
-	host, err := h.FindHost(h.id)
+	host, err := h.findHost(h.id)
 	if err != nil {
-		return err
+		return fsError(err)
 	}
 	b := new(bytes.Buffer)
 	enc := json.NewEncoder(b)
@@ -110,13 +633,60 @@ func (h *host) reload() error {
 	if err := enc.Encode(host); err != nil {
 		return err
 	}
-	h.info = b.Bytes()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.v = &loadedHost{host: host, info: b.Bytes()}
+	h.loaded = time.Now()
+	h.stats.reload(h.dir, h.loaded)
 	return nil
 }
 
+// update calls fn with the host and b, and then reloads the host.
+func (h *host) update(fn func(h *host, v *hostDetail, b []byte) error, b []byte) error {
+	if err := h.writable(); err != nil {
+		return err
+	}
+	v, _, err := h.get()
+	if err != nil {
+		return err
+	}
+	if err := fn(h, v.host, b); err != nil {
+		return fsError(err)
+	}
+	return h.reload()
+}
+
+// hostDetail is a host with the fields mackerel.Host does not have.
+type hostDetail struct {
+	mackerel.Host
+	RetiredAt int64 `json:"retiredAt,omitempty"`
+}
+
+// findHost is FindHost returning hostDetail.
+func (c *client) findHost(id string) (*hostDetail, error) {
+	u := *c.BaseURL
+	u.Path = "/api/v0/hosts/" + url.PathEscape(id)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Request(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var data struct {
+		Host *hostDetail `json:"host"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return data.Host, nil
+}
+
 type hostMetrics struct {
 	id string
-	*mackerel.Client
+	*client
 }
 
 func (h hostMetrics) ListNames() ([]string, error) {
@@ -0,0 +1,142 @@
+package mackerelfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
+)
+
+// hostMetaFS is the meta-system directory of a host, which shows the meta
+// of the host reported by its agent as a tree: a directory for each section,
+// and a file for each field, CPU, block device and file system. The tree
+// is made from the host loaded when it is opened.
+type hostMetaFS struct {
+	h *host
+}
+
+func (f *hostMetaFS) Open(name string) (fs.File, error) {
+	v, loaded, err := f.h.get()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return metaFS(&v.host.Meta, loaded).Open(name)
+}
+
+func metaFS(meta *mackerel.HostMeta, loaded time.Time) fs.FS {
+	m := muxfs.NewFS()
+	m.ModTime(func() time.Time { return loaded })
+	dir := func(name string, files map[string]string) {
+		d := muxfs.NewFS()
+		d.ModTime(func() time.Time { return loaded })
+		for k, s := range files {
+			s := s
+			d.File(escapeName(k), muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+				return strings.NewReader(s), loaded, nil
+			}))
+		}
+		m.FS(name, d)
+	}
+
+	agent := make(map[string]string)
+	for k, s := range map[string]string{
+		"name":     meta.AgentName,
+		"version":  meta.AgentVersion,
+		"revision": meta.AgentRevision,
+	} {
+		if s != "" {
+			agent[k] = s + "\n"
+		}
+	}
+	dir("agent", agent)
+	dir("kernel", lines(meta.Kernel))
+	dir("memory", lines(meta.Memory))
+
+	cpu := make(map[string]string)
+	for i, v := range meta.CPU {
+		cpu[strconv.Itoa(i)] = metaKeyValues(v)
+	}
+	dir("cpu", cpu)
+	blockDevice := make(map[string]string)
+	for name, v := range meta.BlockDevice {
+		blockDevice[name] = metaKeyValues(v)
+	}
+	dir("block_device", blockDevice)
+
+	// File systems are named by their mount points if known, or by the
+	// names given by the agent, usually their devices.
+	filesystem := make(map[string]string)
+	for name, v := range meta.Filesystem {
+		fields, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		if mount, ok := fields["mount"].(string); ok && mount != "" {
+			name = mount
+		}
+		filesystem[name] = metaKeyValues(fields)
+	}
+	dir("filesystem", filesystem)
+
+	cloud := make(map[string]string)
+	if meta.Cloud != nil {
+		cloud["provider"] = meta.Cloud.Provider + "\n"
+		if meta.Cloud.MetaData != nil {
+			b, _ := json.MarshalIndent(meta.Cloud.MetaData, "", "  ")
+			cloud["metadata"] = string(b) + "\n"
+		}
+	}
+	dir("cloud", cloud)
+	return m
+}
+
+// lines returns m whose values are terminated by newlines.
+func lines(m map[string]string) map[string]string {
+	l := make(map[string]string, len(m))
+	for k, s := range m {
+		l[k] = s + "\n"
+	}
+	return l
+}
+
+// metaKeyValues formats m as key=value lines sorted by key.
+func metaKeyValues(m map[string]any) string {
+	s := make(map[string]string, len(m))
+	for k, v := range m {
+		s[k] = metaValue(v)
+	}
+	b := new(bytes.Buffer)
+	keyValues(b, "", s)
+	return b.String()
+}
+
+// metaValue formats a value of the meta decoded from JSON.
+func metaValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// escapeName escapes '/' in s, such as a mount point or a device, so
+// that s can be a file name. The escape character '%' is escaped too.
+func escapeName(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	return strings.ReplaceAll(s, "/", "%2F")
+}
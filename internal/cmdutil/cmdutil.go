@@ -0,0 +1,100 @@
+// Package cmdutil implements the flags and the setup shared by the
+// commands serving mackerelfs.
+package cmdutil
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/rmatsuoka/mackerelfs"
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
+	"github.com/rmatsuoka/mackerelfs/internal/replay"
+)
+
+// Flags are the flags configuring the access to the Mackerel API.
+type Flags struct {
+	recordDir string
+	replayDir string
+	limits    mackerelfs.Limits
+	readOnly  bool
+}
+
+// Register registers the flags in fset.
+func Register(fset *flag.FlagSet) *Flags {
+	f := new(Flags)
+	fset.StringVar(&f.recordDir, "record", "", "record API traffic to `dir`")
+	fset.StringVar(&f.replayDir, "replay", "", "serve API responses recorded in `dir` instead of calling the API")
+	fset.Float64Var(&f.limits.Rate, "rate", mackerelfs.DefaultLimits.Rate, "send at most `n` API requests per second for each organization")
+	fset.IntVar(&f.limits.Burst, "burst", mackerelfs.DefaultLimits.Burst, "allow bursts of `n` API requests")
+	fset.IntVar(&f.limits.Concurrency, "concurrency", mackerelfs.DefaultLimits.Concurrency, "keep at most `n` API requests in flight for each organization")
+	fset.IntVar(&f.limits.Retries, "retries", mackerelfs.DefaultLimits.Retries, "retry an API request failed by rate limiting or a server error at most `n` times")
+	fset.BoolVar(&f.readOnly, "readonly", false, "refuse to change organizations, such as registering and retiring hosts")
+	return f
+}
+
+// Options returns the options of mackerelfs.NewFS given by the flags.
+func (f *Flags) Options() (*mackerelfs.Options, error) {
+	opts := &mackerelfs.Options{
+		Limits:   f.limits,
+		ReadOnly: f.readOnly,
+	}
+	if opts.Limits.Retries == 0 {
+		// A zero field of Limits means the default.
+		opts.Limits.Retries = -1
+	}
+	switch {
+	case f.recordDir != "" && f.replayDir != "":
+		return nil, errors.New("-record and -replay are mutually exclusive")
+	case f.recordDir != "":
+		opts.Transport = &replay.Recorder{Dir: f.recordDir}
+	case f.replayDir != "":
+		opts.Transport = &replay.Replayer{Dir: f.replayDir}
+	}
+	return opts, nil
+}
+
+// Replaying reports whether -replay is given.
+func (f *Flags) Replaying() bool {
+	return f.replayDir != ""
+}
+
+// RegisterReplay registers the organization of the recording in fsys if
+// -replay is given.
+func (f *Flags) RegisterReplay(fsys fs.FS) error {
+	if !f.Replaying() {
+		return nil
+	}
+	// The recording does not contain API keys, so any key works.
+	return Ctl(fsys, "new replay")
+}
+
+// ReadSecret returns the shared secret in file, without the surrounding
+// spaces.
+func ReadSecret(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", errors.New(file + ": empty secret")
+	}
+	return secret, nil
+}
+
+// Ctl writes the command s to the root ctl file of fsys.
+func Ctl(fsys fs.FS, s string) error {
+	f, err := extfs.OpenFile(fsys, "ctl", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f.(io.Writer), s+"\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,54 @@
+package cmdutil
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/rmatsuoka/mackerelfs"
+	"github.com/rmatsuoka/mackerelfs/internal/replay"
+)
+
+func parse(t *testing.T, args ...string) *Flags {
+	t.Helper()
+	fset := flag.NewFlagSet("test", flag.ContinueOnError)
+	fset.SetOutput(io.Discard)
+	f := Register(fset)
+	if err := fset.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestOptions(t *testing.T) {
+	opts, err := parse(t, "-rate", "2", "-readonly", "-replay", "dir").Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mackerelfs.DefaultLimits
+	want.Rate = 2
+	if opts.Limits.Rate != want.Rate || opts.Limits.Burst != want.Burst || opts.Limits.Concurrency != want.Concurrency {
+		t.Errorf("limits are %+v, want %+v", opts.Limits, want)
+	}
+	if !opts.ReadOnly {
+		t.Error("-readonly is not set")
+	}
+	if r, ok := opts.Transport.(*replay.Replayer); !ok || r.Dir != "dir" {
+		t.Errorf("transport is %#v, want a replayer of dir", opts.Transport)
+	}
+
+	if opts.Limits.Retries != want.Retries {
+		t.Errorf("retries is %d, want %d", opts.Limits.Retries, want.Retries)
+	}
+	opts, err = parse(t, "-retries", "0").Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Limits.Retries >= 0 {
+		t.Errorf("-retries 0 gives Retries %d, want a negative value", opts.Limits.Retries)
+	}
+
+	if _, err := parse(t, "-record", "a", "-replay", "b").Options(); err == nil {
+		t.Error("-record and -replay are accepted together")
+	}
+}
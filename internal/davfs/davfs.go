@@ -0,0 +1,124 @@
+// Package davfs adapts an fs.FS to the file system of the WebDAV handler of
+// golang.org/x/net/webdav. Files are written, directories are made and
+// files are removed through extfs.
+package davfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
+)
+
+// New returns the WebDAV file system serving fsys.
+func New(fsys fs.FS) webdav.FileSystem {
+	return &fileSystem{fsys: fsys}
+}
+
+type fileSystem struct {
+	fsys fs.FS
+}
+
+// fsName converts a slash-rooted WebDAV name to a name of fs.FS.
+func fsName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (d *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return extfs.Mkdir(d.fsys, fsName(name), perm)
+}
+
+func (d *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = fsName(name)
+	var (
+		f   fs.File
+		err error
+	)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err = d.fsys.Open(name)
+	} else {
+		f, err = extfs.OpenFile(d.fsys, name, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, name: name}, nil
+}
+
+// RemoveAll removes name through extfs.Remove, which removes a directory
+// with its contents.
+func (d *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	return extfs.Remove(d.fsys, fsName(name))
+}
+
+func (d *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return &fs.PathError{Op: "rename", Path: fsName(oldName), Err: extfs.ErrNotImplemented}
+}
+
+func (d *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.Stat(d.fsys, fsName(name))
+}
+
+// file is an fs.File with the methods of webdav.File. Files which are not
+// io.Seeker can only be sought to the current offset.
+type file struct {
+	fs.File
+	name string
+	off  int64
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	w, ok := f.File.(io.Writer)
+	if !ok {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: extfs.ErrNotImplemented}
+	}
+	return w.Write(p)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		off, err := s.Seek(offset, whence)
+		if err == nil {
+			f.off = off
+		}
+		return off, err
+	}
+	if (whence == io.SeekStart && offset == f.off) || (whence == io.SeekCurrent && offset == 0) {
+		return f.off, nil
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (f *file) Readdir(count int) ([]fs.FileInfo, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	ents, err := d.ReadDir(count)
+	infos := make([]fs.FileInfo, 0, len(ents))
+	for _, e := range ents {
+		info, err := e.Info()
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
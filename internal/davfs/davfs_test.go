@@ -0,0 +1,82 @@
+package davfs
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
+)
+
+func TestWebDAV(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		cmds []string
+	)
+	sub := muxfs.NewFS()
+	sub.File("info", muxfs.ReaderFile(func() (io.Reader, error) {
+		return strings.NewReader("hello\n"), nil
+	}))
+	m := muxfs.NewFS()
+	m.FS("sub", sub)
+	m.File("ctl", muxfs.CtlFile(func(s string) error {
+		if s == "bad" {
+			return errors.New("bad command")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		cmds = append(cmds, s)
+		return nil
+	}))
+	srv := httptest.NewServer(&webdav.Handler{
+		FileSystem: New(m),
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer srv.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method == "PROPFIND" {
+			req.Header.Set("Depth", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, body := do("GET", "/sub/info", ""); code != http.StatusOK || body != "hello\n" {
+		t.Errorf("GET /sub/info: %d %q", code, body)
+	}
+	if code, body := do("PROPFIND", "/", ""); code != http.StatusMultiStatus || !strings.Contains(body, "/sub/") || !strings.Contains(body, "/ctl") {
+		t.Errorf("PROPFIND /: %d %s", code, body)
+	}
+	if code, _ := do("PUT", "/ctl", "reload\n"); code != http.StatusCreated {
+		t.Errorf("PUT /ctl: %d", code)
+	}
+	mu.Lock()
+	if !slices.Equal(cmds, []string{"reload"}) {
+		t.Errorf("ctl received %v, want [reload]", cmds)
+	}
+	mu.Unlock()
+	if code, _ := do("PUT", "/ctl", "bad\n"); code < 400 {
+		t.Errorf("PUT /ctl with a bad command: %d", code)
+	}
+	if code, _ := do("GET", "/nonexistent", ""); code != http.StatusNotFound {
+		t.Errorf("GET /nonexistent: %d, want 404", code)
+	}
+}
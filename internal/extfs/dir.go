@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/fs"
 	"path"
+	"sort"
 	"strings"
 	"time"
 )
@@ -32,6 +33,7 @@ func (d *DirFS) Open(name string) (fs.File, error) {
 	for k, v := range dir.children {
 		ents = append(ents, dirInfo{name: k, perm: v.perm})
 	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
 	return &dirFile{name: path.Base(name), ents: ents, perm: dir.perm}, nil
 }
 
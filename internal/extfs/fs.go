@@ -37,3 +37,15 @@ func Mkdir(fsys fs.FS, name string, perm fs.FileMode) error {
 	}
 	return &fs.PathError{Op: "mkdir", Path: name, Err: ErrNotImplemented}
 }
+
+type RemoveFS interface {
+	fs.FS
+	Remove(name string) error
+}
+
+func Remove(fsys fs.FS, name string) error {
+	if fsys, ok := fsys.(RemoveFS); ok {
+		return fsys.Remove(name)
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: ErrNotImplemented}
+}
@@ -2,7 +2,6 @@ package extfs
 
 import (
 	"errors"
-	"fmt"
 	"io/fs"
 	"os"
 	"path"
@@ -46,7 +45,6 @@ func fixError(err error, name string) error {
 }
 
 func stripPrefix(path, prefix string) string {
-	println("stripPrefix", path, prefix)
 	if prefix == "." {
 		return path
 	}
@@ -74,11 +72,49 @@ func (mfs *mountFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File,
 
 	stripped := stripPrefix(name, prefix)
 	f, err := OpenFile(fsys, stripped, flag, perm)
+	if err != nil {
+		return nil, fixError(err, name)
+	}
 	if stripped == "." {
-		return &nameFile{f, path.Base(name)}, fixError(err, name)
+		f = &nameFile{f, path.Base(name)}
+	}
+	if d, ok := f.(fs.ReadDirFile); ok {
+		return &mountDirFile{ReadDirFile: d, mfs: mfs, name: name}, nil
 	}
+	return f, nil
+}
+
+// mountDirFile is a directory of mountFS. Its entries which are mount points
+// describe the root of the mounted file system rather than the directory
+// they hide.
+type mountDirFile struct {
+	fs.ReadDirFile
+	mfs  *mountFS
+	name string
+}
+
+func (f *mountDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	ents, err := f.ReadDirFile.ReadDir(n)
+	for i, e := range ents {
+		name := path.Join(f.name, e.Name())
+		if v, ok := f.mfs.m.Load(name); ok {
+			ents[i] = &mountDirEntry{DirEntry: e, fsys: v.(fs.FS)}
+		}
+	}
+	return ents, err
+}
 
-	return f, fixError(err, name)
+type mountDirEntry struct {
+	fs.DirEntry
+	fsys fs.FS
+}
+
+func (e *mountDirEntry) Info() (fs.FileInfo, error) {
+	info, err := fs.Stat(e.fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	return &nameFileInfo{info, e.Name()}, nil
 }
 
 func (mfs *mountFS) Open(name string) (fs.File, error) {
@@ -93,6 +129,18 @@ func (mfs *mountFS) Mkdir(name string, perm fs.FileMode) error {
 	return Mkdir(fsys, stripPrefix(name, prefix), perm)
 }
 
+func (mfs *mountFS) Remove(name string) error {
+	fsys, prefix, err := mfs.lookup(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if prefix == name {
+		// Unmounting is not removing.
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return Remove(fsys, stripPrefix(name, prefix))
+}
+
 func (mfs *mountFS) Mount(name string, fsys fs.FS) error {
 	if !fs.ValidPath(name) {
 		return &fs.PathError{Op: "mount", Path: name, Err: fs.ErrInvalid}
@@ -120,7 +168,6 @@ func (mfs *mountFS) lookup(name string) (fsys fs.FS, prefix string, err error) {
 
 	walkToRoot(name)(func(s string) bool {
 		v, ok := mfs.m.Load(s)
-		fmt.Printf("lookup %s: %s %v\n", name, s, ok)
 		if ok {
 			fsys = v.(fs.FS)
 			prefix = s
@@ -0,0 +1,66 @@
+package extfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// ReadOnlyFS returns a file system which opens files of fsys only for
+// reading. Opening a file for writing and making a directory fail with
+// fs.ErrPermission, as does removing a file, and the opened files do not implement io.Writer.
+func ReadOnlyFS(fsys fs.FS) fs.FS {
+	return &readOnlyFS{fsys}
+}
+
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+var (
+	_ OpenFileFS = &readOnlyFS{}
+	_ MkdirFS    = &readOnlyFS{}
+	_ RemoveFS   = &readOnlyFS{}
+)
+
+func (r *readOnlyFS) Open(name string) (fs.File, error) {
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	switch f := f.(type) {
+	case fs.ReadDirFile:
+		return readOnlyDir{f}, nil
+	case readerAtFile:
+		return readOnlyReaderAt{f}, nil
+	}
+	return readOnlyFile{f}, nil
+}
+
+type readerAtFile interface {
+	fs.File
+	io.ReaderAt
+}
+
+// readOnlyFile, readOnlyDir and readOnlyReaderAt hide methods other than
+// those of the embedded interfaces, in particular Write.
+type (
+	readOnlyFile     struct{ fs.File }
+	readOnlyDir      struct{ fs.ReadDirFile }
+	readOnlyReaderAt struct{ readerAtFile }
+)
+
+func (r *readOnlyFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &fs.PathError{Op: "openfile", Path: name, Err: fs.ErrPermission}
+	}
+	return r.Open(name)
+}
+
+func (r *readOnlyFS) Mkdir(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (r *readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
@@ -0,0 +1,41 @@
+package extfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadOnlyFS(t *testing.T) {
+	d := NewDirFS(0555)
+	if err := d.Mkdir("foo", 0555); err != nil {
+		t.Fatal(err)
+	}
+	fsys := ReadOnlyFS(d)
+	if err := fstest.TestFS(fsys, "foo"); err != nil {
+		t.Error(err)
+	}
+	if err := Mkdir(fsys, "bar", 0555); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Mkdir returns %v, want ErrPermission", err)
+	}
+	if err := Remove(fsys, "foo"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Remove returns %v, want ErrPermission", err)
+	}
+	if _, err := OpenFile(fsys, "foo", os.O_WRONLY, 0); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("OpenFile for writing returns %v, want ErrPermission", err)
+	}
+	f, err := fsys.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, ok := f.(io.Writer); ok {
+		t.Error("file opened for reading is an io.Writer")
+	}
+	if _, ok := f.(fs.ReadDirFile); !ok {
+		t.Error("directory is not an fs.ReadDirFile")
+	}
+}
@@ -0,0 +1,308 @@
+//go:build linux
+
+// Package fusefs serves an fs.FS as a FUSE file system. Files are written
+// through extfs.OpenFile, so that ctl files of muxfs can be written, and
+// directories are made and files are removed through extfs.Mkdir and
+// extfs.Remove.
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
+)
+
+// Errno translates err returned by an fs.FS to an errno.
+func Errno(err error) syscall.Errno {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, fs.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+	case errors.Is(err, fs.ErrClosed):
+		return syscall.EBADF
+	case errors.Is(err, extfs.ErrNotImplemented):
+		return syscall.ENOTSUP
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	}
+	return syscall.EIO
+}
+
+// New returns the root node of a FUSE file system serving fsys.
+// errno translates the errors of fsys; if nil, Errno is used.
+func New(fsys fs.FS, errno func(error) syscall.Errno) gofs.InodeEmbedder {
+	if errno == nil {
+		errno = Errno
+	}
+	return &node{fsys: fsys, name: ".", errno: errno}
+}
+
+type node struct {
+	gofs.Inode
+	fsys  fs.FS
+	name  string // path in fsys
+	errno func(error) syscall.Errno
+
+	mu      sync.Mutex
+	writers map[*handle]bool // open handles for writing
+}
+
+var (
+	_ gofs.NodeLookuper  = (*node)(nil)
+	_ gofs.NodeGetattrer = (*node)(nil)
+	_ gofs.NodeSetattrer = (*node)(nil)
+	_ gofs.NodeReaddirer = (*node)(nil)
+	_ gofs.NodeOpener    = (*node)(nil)
+	_ gofs.NodeMkdirer   = (*node)(nil)
+	_ gofs.NodeUnlinker  = (*node)(nil)
+	_ gofs.NodeRmdirer   = (*node)(nil)
+)
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	child := &node{fsys: n.fsys, name: path.Join(n.name, name), errno: n.errno}
+	info, err := fs.Stat(n.fsys, child.name)
+	if err != nil {
+		return nil, n.errno(err)
+	}
+	setAttr(&out.Attr, info)
+	return n.NewInode(ctx, child, gofs.StableAttr{Mode: fileType(info.IsDir())}), 0
+}
+
+func (n *node) Getattr(ctx context.Context, _ gofs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	info, err := fs.Stat(n.fsys, n.name)
+	if err != nil {
+		return n.errno(err)
+	}
+	setAttr(&out.Attr, info)
+	return 0
+}
+
+// Setattr changes nothing but the size of the open files implementing
+// truncater. It succeeds so that shells can truncate ctl files on
+// redirection. The kernel opens a file with O_TRUNC without the flag and
+// then truncates it without the handle, so the size is set to all the
+// handles of n open for writing.
+func (n *node) Setattr(ctx context.Context, fh gofs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		var handles []*handle
+		if h, ok := fh.(*handle); ok {
+			handles = append(handles, h)
+		} else {
+			n.mu.Lock()
+			for h := range n.writers {
+				handles = append(handles, h)
+			}
+			n.mu.Unlock()
+		}
+		for _, h := range handles {
+			if errno := h.truncate(int64(size)); errno != 0 {
+				return errno
+			}
+		}
+	}
+	return n.Getattr(ctx, fh, out)
+}
+
+func (n *node) Readdir(ctx context.Context) (gofs.DirStream, syscall.Errno) {
+	ents, err := fs.ReadDir(n.fsys, n.name)
+	if err != nil {
+		return nil, n.errno(err)
+	}
+	list := make([]fuse.DirEntry, len(ents))
+	for i, e := range ents {
+		list[i] = fuse.DirEntry{Name: e.Name(), Mode: fileType(e.IsDir())}
+	}
+	return gofs.NewListDirStream(list), 0
+}
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	if err := extfs.Mkdir(n.fsys, path.Join(n.name, name), fs.FileMode(mode).Perm()); err != nil {
+		return nil, n.errno(err)
+	}
+	return n.Lookup(ctx, name, out)
+}
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.errno(extfs.Remove(n.fsys, path.Join(n.name, name)))
+}
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.errno(extfs.Remove(n.fsys, path.Join(n.name, name)))
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (gofs.FileHandle, uint32, syscall.Errno) {
+	flag := int(flags) & (syscall.O_ACCMODE | syscall.O_APPEND | syscall.O_TRUNC)
+	f, err := extfs.OpenFile(n.fsys, n.name, flag, 0)
+	if err != nil {
+		return nil, 0, n.errno(err)
+	}
+	h := &handle{f: f, errno: n.errno}
+	if flag&syscall.O_ACCMODE != syscall.O_RDONLY {
+		n.mu.Lock()
+		if n.writers == nil {
+			n.writers = make(map[*handle]bool)
+		}
+		n.writers[h] = true
+		n.mu.Unlock()
+		h.release = func() {
+			n.mu.Lock()
+			delete(n.writers, h)
+			n.mu.Unlock()
+		}
+	}
+	// The content is generated on open, so the size reported by stat
+	// is not reliable and the page cache must not be used.
+	return h, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func fileType(dir bool) uint32 {
+	if dir {
+		return syscall.S_IFDIR
+	}
+	return syscall.S_IFREG
+}
+
+func setAttr(a *fuse.Attr, info fs.FileInfo) {
+	a.Mode = fileType(info.IsDir()) | uint32(info.Mode().Perm())
+	a.Size = uint64(info.Size())
+	a.Nlink = 1
+	t := info.ModTime()
+	if t.IsZero() {
+		t = time.Now()
+	}
+	a.SetTimes(&t, &t, &t)
+}
+
+// handle is an open file. Reads are sequential unless the file
+// implements io.ReaderAt. A sequential read of a file implementing
+// contextReader is interrupted when the reading process is interrupted.
+type handle struct {
+	mu     sync.Mutex
+	f      fs.File
+	off    int64 // offset of the next sequential read
+	closed bool
+	errno  func(error) syscall.Errno
+
+	release func() // if non-nil, called when closed
+}
+
+// truncater is implemented by files whose content can be truncated, such
+// as the writable files of muxfs.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// contextReader is implemented by files whose reads may block.
+// ReadContext is like Read but returns ctx.Err() if ctx is done before
+// data arrives.
+type contextReader interface {
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+var (
+	_ gofs.FileReader   = (*handle)(nil)
+	_ gofs.FileWriter   = (*handle)(nil)
+	_ gofs.FileFlusher  = (*handle)(nil)
+	_ gofs.FileReleaser = (*handle)(nil)
+)
+
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, syscall.EBADF
+	}
+	var (
+		n   int
+		err error
+	)
+	if ra, ok := h.f.(io.ReaderAt); ok {
+		n, err = ra.ReadAt(dest, off)
+	} else if off == h.off {
+		if cr, ok := h.f.(contextReader); ok {
+			n, err = cr.ReadContext(ctx, dest)
+		} else {
+			n, err = io.ReadAtLeast(h.f, dest, 1)
+		}
+		h.off += int64(n)
+	} else {
+		return nil, syscall.ESPIPE
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, h.errno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *handle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0, syscall.EBADF
+	}
+	w, ok := h.f.(io.Writer)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	n, err := w.Write(data)
+	if err != nil {
+		return uint32(n), h.errno(err)
+	}
+	return uint32(n), 0
+}
+
+func (h *handle) truncate(size int64) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return syscall.EBADF
+	}
+	t, ok := h.f.(truncater)
+	if !ok {
+		return 0
+	}
+	return h.errno(t.Truncate(size))
+}
+
+// Flush closes the file, so that errors of ctl commands, which are
+// reported on close, are returned by close(2).
+func (h *handle) Flush(ctx context.Context) syscall.Errno {
+	return h.close()
+}
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	return h.close()
+}
+
+func (h *handle) close() syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0
+	}
+	h.closed = true
+	if h.release != nil {
+		h.release()
+	}
+	return h.errno(h.f.Close())
+}
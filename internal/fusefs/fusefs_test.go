@@ -0,0 +1,223 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
+)
+
+func mount(t *testing.T, root gofs.InodeEmbedder) string {
+	t.Helper()
+	dir := t.TempDir()
+	srv, err := gofs.Mount(dir, root, &gofs.Options{
+		MountOptions: fuse.MountOptions{DirectMount: true},
+	})
+	if err != nil {
+		t.Skipf("cannot mount FUSE: %v", err)
+	}
+	t.Cleanup(func() { srv.Unmount() })
+	return dir
+}
+
+func TestFUSE(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		cmds []string
+	)
+	sub := muxfs.NewFS()
+	sub.File("info", muxfs.ReaderFile(func() (io.Reader, error) {
+		return strings.NewReader("hello\n"), nil
+	}))
+	m := muxfs.NewFS()
+	m.FS("sub", sub)
+	m.File("ctl", muxfs.CtlFile(func(s string) error {
+		if s == "bad" {
+			return errors.New("bad command")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		cmds = append(cmds, s)
+		return nil
+	}))
+	dir := mount(t, New(m, nil))
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	if want := []string{"ctl", "sub"}; !slices.Equal(names, want) {
+		t.Errorf("ReadDir returns %v, want %v", names, want)
+	}
+	if !ents[1].IsDir() {
+		t.Error("sub is not a directory")
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "sub/info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("hello\n")) {
+		t.Errorf("sub/info is %q, want %q", b, "hello\n")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "ctl"), []byte("reload\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if !slices.Equal(cmds, []string{"reload"}) {
+		t.Errorf("ctl received %v, want [reload]", cmds)
+	}
+	mu.Unlock()
+	if err := os.WriteFile(filepath.Join(dir, "ctl"), []byte("bad\n"), 0); err == nil {
+		t.Error("a failed command is not reported")
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "nonexistent"))
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Stat(nonexistent) returns %v, want ENOENT", err)
+	}
+}
+
+func TestErrno(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, syscall.ENOENT},
+		{os.ErrPermission, syscall.EACCES},
+		{os.ErrInvalid, syscall.EINVAL},
+		{syscall.EAGAIN, syscall.EAGAIN},
+		{errors.New("other"), syscall.EIO},
+	} {
+		if got := Errno(tt.err); got != tt.want {
+			t.Errorf("Errno(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// dirs is a muxfs.MkdirVarFS and muxfs.RemoveVarFS of directories, each
+// of which has a file.
+type dirs struct {
+	mu sync.Mutex
+	m  map[string]fs.FS
+}
+
+func (d *dirs) All() (muxfs.Seq[string], error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var names []string
+	for name := range d.m {
+		names = append(names, name)
+	}
+	return func(yield func(string) bool) {
+		for _, name := range names {
+			if !yield(name) {
+				return
+			}
+		}
+	}, nil
+}
+
+func (d *dirs) FS(name string) (fs.FS, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.m[name]
+	return f, ok
+}
+
+func (d *dirs) Mkdir(name string, perm fs.FileMode) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := muxfs.NewFS()
+	m.File("file", muxfs.ReaderFile(func() (io.Reader, error) {
+		return strings.NewReader("hello\n"), nil
+	}))
+	m.IgnoreRemove()
+	d.m[name] = m
+	return nil
+}
+
+func (d *dirs) Remove(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.m, name)
+	return nil
+}
+
+func TestFUSEMkdirRemove(t *testing.T) {
+	m := muxfs.NewFS()
+	m.VarFS(&dirs{m: make(map[string]fs.FS)})
+	dir := mount(t, New(m, nil))
+
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "a")); err != nil || !info.IsDir() {
+		t.Errorf("a is not made: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Mkdir of an existing directory returns %v, want %v", err, fs.ErrExist)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "a/b"), 0755); !errors.Is(err, syscall.ENOTSUP) {
+		t.Errorf("Mkdir in a directory without MkdirVarFS returns %v, want %v", err, syscall.ENOTSUP)
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a exists after removal: %v", err)
+	}
+}
+
+func TestFUSETruncate(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		written []string
+	)
+	m := muxfs.NewFS()
+	m.File("memo", muxfs.WritableFile(func() (io.Reader, time.Time, error) {
+		return strings.NewReader("old\n"), time.Time{}, nil
+	}, func(b []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, string(b))
+		return nil
+	}))
+	dir := mount(t, New(m, nil))
+
+	// : > memo
+	f, err := os.OpenFile(filepath.Join(dir, "memo"), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(written, []string{""}) {
+		t.Errorf("memo is written %q, want the empty content", written)
+	}
+}
@@ -0,0 +1,518 @@
+// Package mackereltest provides an in-process fake of the Mackerel API
+// for hermetic tests.
+package mackereltest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// Fixture is the state served by a Server.
+type Fixture struct {
+	APIKey   string
+	Org      string
+	Hosts    []*mackerel.Host
+	Services []*mackerel.Service
+
+	// Roles maps a service name to its roles.
+	Roles map[string][]*mackerel.Role
+
+	// HostMetrics maps a host ID and a metric name to its values.
+	HostMetrics map[string]map[string][]mackerel.MetricValue
+
+	// ServiceMetrics maps a service name and a metric name to its values.
+	ServiceMetrics map[string]map[string][]mackerel.MetricValue
+
+	Alerts []*mackerel.Alert
+
+	// Monitors must have their types set, as returned by the API.
+	Monitors []mackerel.Monitor
+
+	GraphAnnotations []*mackerel.GraphAnnotation
+
+	// RetiredAt maps the ID of a retired host to the time it is retired.
+	RetiredAt map[string]int64
+}
+
+// Server is a fake Mackerel API server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	f        Fixture
+	failures int
+	nextID   int
+	failCode int
+	delay    time.Duration
+	requests map[string]int
+}
+
+// NewServer starts a Server serving f.
+// The caller should call Close when finished, to shut it down.
+func NewServer(f *Fixture) *Server {
+	s := &Server{f: *f, requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewClient returns a client of s authenticated with the fixture's API key.
+func (s *Server) NewClient() *mackerel.Client {
+	c, _ := mackerel.NewClientWithOptions(s.f.APIKey, s.URL, false)
+	return c
+}
+
+// Update calls fn with the fixture held by s, so that tests can change
+// the state while the server is running.
+func (s *Server) Update(fn func(f *Fixture)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.f)
+}
+
+// FailNext makes s answer the next n requests with the HTTP status code.
+func (s *Server) FailNext(n int, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+	s.failCode = code
+}
+
+// SetDelay makes s wait d before answering each request.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// Requests returns the number of requests received for the method and
+// the path, such as "GET /api/v0/hosts".
+func (s *Server) Requests(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method+" "+path]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.Method+" "+r.URL.Path]++
+	delay := s.delay
+	s.mu.Unlock()
+	time.Sleep(delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		writeError(w, s.failCode, http.StatusText(s.failCode))
+		return
+	}
+
+	if r.Header.Get("X-Api-Key") != s.f.APIKey {
+		writeError(w, http.StatusForbidden, "Authentication failed.")
+		return
+	}
+
+	elem := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(elem) < 3 || elem[0] != "api" || elem[1] != "v0" {
+		writeError(w, http.StatusNotFound, "Not Found.")
+		return
+	}
+	elem = elem[2:]
+
+	switch {
+	case match(r, elem, "GET", "org"):
+		writeJSON(w, mackerel.Org{Name: s.f.Org})
+	case match(r, elem, "GET", "hosts"):
+		s.findHosts(w, r)
+	case match(r, elem, "POST", "hosts"):
+		var param mackerel.CreateHostParam
+		if !readJSON(w, r, &param) {
+			return
+		}
+		if param.Name == "" {
+			writeError(w, http.StatusBadRequest, "Invalid parameter: name.")
+			return
+		}
+		s.nextID++
+		host := &mackerel.Host{
+			ID:        "newhost" + strconv.Itoa(s.nextID),
+			Status:    mackerel.HostStatusWorking,
+			CreatedAt: int32(time.Now().Unix()),
+		}
+		setHost(host, (*mackerel.UpdateHostParam)(&param))
+		s.f.Hosts = append(s.f.Hosts, host)
+		writeJSON(w, map[string]string{"id": host.ID})
+	case match(r, elem, "PUT", "hosts", "*"):
+		host := s.host(elem[1])
+		if host == nil {
+			writeError(w, http.StatusNotFound, "Host Not Found.")
+			return
+		}
+		var param mackerel.UpdateHostParam
+		if !readJSON(w, r, &param) {
+			return
+		}
+		setHost(host, &param)
+		writeJSON(w, map[string]string{"id": host.ID})
+	case match(r, elem, "PUT", "hosts", "*", "role-fullnames"):
+		host := s.host(elem[1])
+		if host == nil {
+			writeError(w, http.StatusNotFound, "Host Not Found.")
+			return
+		}
+		var param struct {
+			RoleFullnames []string `json:"roleFullnames"`
+		}
+		if !readJSON(w, r, &param) {
+			return
+		}
+		roles, ok := parseRoles(param.RoleFullnames)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Invalid parameter: roleFullnames.")
+			return
+		}
+		host.Roles = roles
+		writeJSON(w, map[string]bool{"success": true})
+	case match(r, elem, "GET", "hosts", "*"):
+		host := s.host(elem[1])
+		if host == nil {
+			writeError(w, http.StatusNotFound, "Host Not Found.")
+			return
+		}
+		writeJSON(w, map[string]any{"host": struct {
+			*mackerel.Host
+			RetiredAt int64 `json:"retiredAt,omitempty"`
+		}{host, s.f.RetiredAt[host.ID]}})
+	case match(r, elem, "POST", "hosts", "*", "retire"):
+		host := s.host(elem[1])
+		if host == nil || host.IsRetired {
+			writeError(w, http.StatusNotFound, "Host Not Found.")
+			return
+		}
+		host.IsRetired = true
+		if s.f.RetiredAt == nil {
+			s.f.RetiredAt = make(map[string]int64)
+		}
+		s.f.RetiredAt[host.ID] = time.Now().Unix()
+		writeJSON(w, map[string]bool{"success": true})
+	case match(r, elem, "GET", "hosts", "*", "metric-names"):
+		if s.host(elem[1]) == nil {
+			writeError(w, http.StatusNotFound, "Host Not Found.")
+			return
+		}
+		writeJSON(w, map[string]any{"names": metricNames(s.f.HostMetrics[elem[1]])})
+	case match(r, elem, "GET", "hosts", "*", "metrics"):
+		if s.host(elem[1]) == nil {
+			writeError(w, http.StatusNotFound, "Host Not Found.")
+			return
+		}
+		s.fetchMetrics(w, r, s.f.HostMetrics[elem[1]])
+	case match(r, elem, "GET", "services"):
+		writeJSON(w, map[string]any{"services": nonNil(s.f.Services)})
+	case match(r, elem, "GET", "services", "*", "roles"):
+		if s.service(elem[1]) == nil {
+			writeError(w, http.StatusNotFound, "Service Not Found.")
+			return
+		}
+		writeJSON(w, map[string]any{"roles": nonNil(s.f.Roles[elem[1]])})
+	case match(r, elem, "GET", "services", "*", "metric-names"):
+		if s.service(elem[1]) == nil {
+			writeError(w, http.StatusNotFound, "Service Not Found.")
+			return
+		}
+		writeJSON(w, map[string]any{"names": metricNames(s.f.ServiceMetrics[elem[1]])})
+	case match(r, elem, "GET", "services", "*", "metrics"):
+		if s.service(elem[1]) == nil {
+			writeError(w, http.StatusNotFound, "Service Not Found.")
+			return
+		}
+		s.fetchMetrics(w, r, s.f.ServiceMetrics[elem[1]])
+	case match(r, elem, "GET", "monitors"):
+		writeJSON(w, map[string]any{"monitors": nonNil(s.f.Monitors)})
+	case match(r, elem, "GET", "monitors", "*"):
+		i := slices.IndexFunc(s.f.Monitors, func(m mackerel.Monitor) bool { return m.MonitorID() == elem[1] })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "Monitor Not Found.")
+			return
+		}
+		writeJSON(w, map[string]any{"monitor": s.f.Monitors[i]})
+	case match(r, elem, "DELETE", "monitors", "*"):
+		i := slices.IndexFunc(s.f.Monitors, func(m mackerel.Monitor) bool { return m.MonitorID() == elem[1] })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "Monitor Not Found.")
+			return
+		}
+		m := s.f.Monitors[i]
+		s.f.Monitors = slices.Delete(s.f.Monitors, i, i+1)
+		writeJSON(w, m)
+	case match(r, elem, "GET", "graph-annotations"):
+		s.findGraphAnnotations(w, r)
+	case match(r, elem, "DELETE", "graph-annotations", "*"):
+		i := slices.IndexFunc(s.f.GraphAnnotations, func(a *mackerel.GraphAnnotation) bool { return a.ID == elem[1] })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "Graph Annotation Not Found.")
+			return
+		}
+		a := s.f.GraphAnnotations[i]
+		s.f.GraphAnnotations = slices.Delete(s.f.GraphAnnotations, i, i+1)
+		writeJSON(w, a)
+	case match(r, elem, "GET", "alerts"):
+		s.findAlerts(w, r)
+	case match(r, elem, "GET", "alerts", "*"):
+		i := slices.IndexFunc(s.f.Alerts, func(a *mackerel.Alert) bool { return a.ID == elem[1] })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "Alert Not Found.")
+			return
+		}
+		writeJSON(w, s.f.Alerts[i])
+	case match(r, elem, "PUT", "alerts", "*"):
+		i := slices.IndexFunc(s.f.Alerts, func(a *mackerel.Alert) bool { return a.ID == elem[1] })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "Alert Not Found.")
+			return
+		}
+		// Unlike mackerel.UpdateAlertParam, memo is required.
+		var param struct {
+			Memo *string `json:"memo"`
+		}
+		if !readJSON(w, r, &param) {
+			return
+		}
+		if param.Memo == nil {
+			writeError(w, http.StatusBadRequest, "memo is required.")
+			return
+		}
+		s.f.Alerts[i].Memo = *param.Memo
+		writeJSON(w, mackerel.UpdateAlertResponse{Memo: *param.Memo})
+	default:
+		writeError(w, http.StatusNotFound, "Not Found.")
+	}
+}
+
+// match reports whether the request method is method and elem matches pattern.
+// "*" in pattern matches any single element.
+func match(r *http.Request, elem []string, method string, pattern ...string) bool {
+	if r.Method != method || len(elem) != len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != elem[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) host(id string) *mackerel.Host {
+	for _, h := range s.f.Hosts {
+		if h.ID == id {
+			return h
+		}
+	}
+	return nil
+}
+
+// setHost sets the fields of host given by param.
+func setHost(host *mackerel.Host, param *mackerel.UpdateHostParam) {
+	host.Name = param.Name
+	host.DisplayName = param.DisplayName
+	host.Memo = param.Memo
+	host.Meta = param.Meta
+	host.Interfaces = param.Interfaces
+	host.CustomIdentifier = param.CustomIdentifier
+	host.Roles, _ = parseRoles(param.RoleFullnames)
+}
+
+// parseRoles parses role full names, such as "service:role".
+func parseRoles(fullnames []string) (mackerel.Roles, bool) {
+	roles := make(mackerel.Roles)
+	for _, s := range fullnames {
+		service, role, ok := strings.Cut(s, ":")
+		if !ok || service == "" || role == "" {
+			return nil, false
+		}
+		roles[service] = append(roles[service], role)
+	}
+	return roles, true
+}
+
+func (s *Server) service(name string) *mackerel.Service {
+	for _, v := range s.f.Services {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *Server) findHosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	service := q.Get("service")
+	roles := q["role"]
+	name := q.Get("name")
+	statuses := q["status"]
+
+	hosts := []*mackerel.Host{}
+	for _, h := range s.f.Hosts {
+		if h.IsRetired {
+			continue
+		}
+		if name != "" && h.Name != name {
+			continue
+		}
+		if len(statuses) > 0 && !slices.Contains(statuses, h.Status) {
+			continue
+		}
+		if service != "" {
+			hostRoles, ok := h.Roles[service]
+			if !ok {
+				continue
+			}
+			if len(roles) > 0 && !containsAny(hostRoles, roles) {
+				continue
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	writeJSON(w, map[string]any{"hosts": hosts})
+}
+
+func containsAny(s, v []string) bool {
+	for _, e := range v {
+		if slices.Contains(s, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func metricNames(m map[string][]mackerel.MetricValue) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) fetchMetrics(w http.ResponseWriter, r *http.Request, m map[string][]mackerel.MetricValue) {
+	q := r.URL.Query()
+	from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: from.")
+		return
+	}
+	to, err := strconv.ParseInt(q.Get("to"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: to.")
+		return
+	}
+	values := []mackerel.MetricValue{}
+	for _, v := range m[q.Get("name")] {
+		if from <= v.Time && v.Time <= to {
+			values = append(values, v)
+		}
+	}
+	writeJSON(w, map[string]any{"metrics": values})
+}
+
+func (s *Server) findGraphAnnotations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	service := q.Get("service")
+	if s.service(service) == nil {
+		writeError(w, http.StatusNotFound, "Service Not Found.")
+		return
+	}
+	from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: from.")
+		return
+	}
+	to, err := strconv.ParseInt(q.Get("to"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: to.")
+		return
+	}
+	annotations := []*mackerel.GraphAnnotation{}
+	for _, a := range s.f.GraphAnnotations {
+		if a.Service == service && a.From <= to && from <= a.To {
+			annotations = append(annotations, a)
+		}
+	}
+	writeJSON(w, map[string]any{"graphAnnotations": annotations})
+}
+
+const alertsPageSize = 100
+
+func (s *Server) findAlerts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	withClosed := q.Get("withClosed") == "true"
+
+	var alerts []*mackerel.Alert
+	for _, a := range s.f.Alerts {
+		if a.Status == "OK" && !withClosed {
+			continue
+		}
+		alerts = append(alerts, a)
+	}
+	// Mackerel returns alerts newest first.
+	sort.SliceStable(alerts, func(i, j int) bool {
+		return alerts[i].OpenedAt > alerts[j].OpenedAt
+	})
+
+	if nextID := q.Get("nextId"); nextID != "" {
+		i := slices.IndexFunc(alerts, func(a *mackerel.Alert) bool { return a.ID == nextID })
+		if i < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid parameter: nextId.")
+			return
+		}
+		alerts = alerts[i:]
+	}
+	resp := mackerel.AlertsResp{Alerts: []*mackerel.Alert{}}
+	if len(alerts) > alertsPageSize {
+		resp.NextID = alerts[alertsPageSize].ID
+		alerts = alerts[:alertsPageSize]
+	}
+	resp.Alerts = append(resp.Alerts, alerts...)
+	writeJSON(w, resp)
+}
+
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// readJSON decodes the request body to v. If it fails, it writes the
+// error response and returns false.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON.")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]string{"message": message},
+	})
+}
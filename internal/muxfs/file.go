@@ -1,30 +1,69 @@
 package muxfs
 
 import (
-	"bufio"
+	"bytes"
 	"io"
 	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-func ReaderFile(f func() (io.Reader, error)) File {
+// FuncFile returns the file opened by open, which is called with the base
+// name of the file and the flags given to FS.OpenFile.
+func FuncFile(open func(name string, flag int) (fs.File, error)) File {
 	return func(o *openArgs) (fs.File, error) {
+		return open(o.base(), o.flag)
+	}
+}
+
+func ReaderFile(f func() (io.Reader, error)) File {
+	return ModReaderFile(func() (io.Reader, time.Time, error) {
 		r, err := f()
+		return r, time.Time{}, err
+	})
+}
+
+// ModReaderFile is like ReaderFile but f also returns the modification time
+// of the content. If the reader has a Len method, such as *bytes.Reader,
+// *bytes.Buffer or *strings.Reader, the size of the file is reported too.
+// If the reader also implements io.Seeker and io.ReaderAt, such as
+// *bytes.Reader and *strings.Reader, so does the file.
+func ModReaderFile(f func() (io.Reader, time.Time, error)) File {
+	return func(o *openArgs) (fs.File, error) {
+		r, modTime, err := f()
 		if err != nil {
 			return nil, &fs.PathError{Op: "open", Path: o.base(), Err: err}
 		}
-		return &readerFile{Reader: r, name: o.base()}, nil
+		var size int64
+		if l, ok := r.(interface{ Len() int }); ok {
+			size = int64(l.Len())
+		}
+		f := &readerFile{Reader: r, name: o.base(), size: size, modTime: modTime}
+		if _, ok := r.(readSeekerAt); ok {
+			return &seekableFile{f}, nil
+		}
+		return f, nil
 	}
 }
 
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
 type readerFile struct {
-	name string
+	name    string
+	size    int64
+	modTime time.Time
 	io.Reader
 }
 
 var _ fs.File = &readerFile{}
 
 func (f *readerFile) Stat() (fs.FileInfo, error) {
-	return &fileInfo{name: f.name, mode: 0444}, nil
+	return &fileInfo{name: f.name, mode: 0444, size: f.size, modTime: f.modTime}, nil
 }
 
 func (f *readerFile) Close() error {
@@ -34,42 +73,353 @@ func (f *readerFile) Close() error {
 	return nil
 }
 
-func CtlFile(fn func(s string) error) File {
+// seekableFile is a readerFile whose reader is a readSeekerAt.
+type seekableFile struct {
+	*readerFile
+}
+
+func (f *seekableFile) Seek(offset int64, whence int) (int64, error) {
+	return f.Reader.(io.Seeker).Seek(offset, whence)
+}
+
+func (f *seekableFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.Reader.(io.ReaderAt).ReadAt(p, off)
+}
+
+// WritableFile is like ModReaderFile but the file can be written too.
+// The content written to an open file is passed to write when the file is
+// closed, and the error of write is returned by Close. A file opened with
+// os.O_RDWR starts with the content of read unless os.O_TRUNC is given;
+// a file opened with os.O_WRONLY starts empty unless os.O_APPEND is given,
+// with which writes are appended to the content. Opening with os.O_TRUNC
+// writes the empty content even if nothing is written. A file opened only
+// for reading accepts writes as well, since some servers do not pass the
+// open flags, and then starts empty.
+func WritableFile(read func() (io.Reader, time.Time, error), write func(b []byte) error) File {
+	return LazyWritableFile(nil, read, write)
+}
+
+// LazyWritableFile is like WritableFile but a file opened only for
+// reading calls read on the first read instead of on open. Until then,
+// stat, if non-nil, reports the size and the modification time of the
+// file, so that stating it, such as by listing the directory, does not
+// call read.
+func LazyWritableFile(stat func() (int64, time.Time), read func() (io.Reader, time.Time, error), write func(b []byte) error) File {
 	return func(o *openArgs) (fs.File, error) {
-		return newCtlFile(o.base(), fn), nil
+		f := &writableFile{name: o.base(), write: write}
+		if o.flag&os.O_TRUNC != 0 {
+			f.dirty = true
+		}
+		if o.flag&os.O_TRUNC != 0 || o.flag&(os.O_WRONLY|os.O_APPEND) == os.O_WRONLY {
+			return f, nil
+		}
+		f.read = read
+		if stat != nil && o.flag&(os.O_RDWR|os.O_APPEND) == 0 {
+			f.stat = stat
+			return f, nil
+		}
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+		if o.flag&(os.O_RDWR|os.O_APPEND) != 0 {
+			f.buf = bytes.Clone(f.content)
+		}
+		f.append = o.flag&os.O_APPEND != 0
+		return f, nil
 	}
 }
 
-type ctlFile struct {
-	name string
-	w    *io.PipeWriter
-	done <-chan struct{}
-}
-
-func newCtlFile(base string, fn func(s string) error) *ctlFile {
-	r, w := io.Pipe()
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		s := bufio.NewScanner(r)
-		for s.Scan() {
-			if err := fn(s.Text()); err != nil {
-				r.CloseWithError(err)
-				return
+type writableFile struct {
+	name   string
+	write  func(b []byte) error
+	stat   func() (int64, time.Time) // nil once loaded
+	append bool                      // writes are appended; see os.O_APPEND
+
+	mu      sync.Mutex
+	read    func() (io.Reader, time.Time, error) // nil once loaded
+	content []byte                               // returned by read
+	modTime time.Time
+	buf     []byte // written content
+	dirty   bool
+	off     int64 // offset of Read and Write
+}
+
+// load reads the content if it is not read yet. f.mu must be held unless
+// f is being opened.
+func (f *writableFile) load() error {
+	if f.read == nil {
+		return nil
+	}
+	r, modTime, err := f.read()
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: f.name, Err: err}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	f.content, f.modTime = b, modTime
+	f.read, f.stat = nil, nil
+	return nil
+}
+
+func (f *writableFile) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stat != nil && !f.dirty && f.buf == nil {
+		size, modTime := f.stat()
+		return &fileInfo{name: f.name, mode: 0666, size: size, modTime: modTime}, nil
+	}
+	return &fileInfo{name: f.name, mode: 0666, size: int64(len(f.data())), modTime: f.modTime}, nil
+}
+
+// data returns the content read from f.
+func (f *writableFile) data() []byte {
+	if f.dirty || f.buf != nil {
+		return f.buf
+	}
+	return f.content
+}
+
+func (f *writableFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty && f.buf == nil {
+		if err := f.load(); err != nil {
+			return 0, err
+		}
+	}
+	return bytes.NewReader(f.data()).ReadAt(p, off)
+}
+
+func (f *writableFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *writableFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.buf)) {
+		f.buf = append(f.buf, make([]byte, end-int64(len(f.buf)))...)
+	}
+	copy(f.buf[off:], p)
+	f.dirty = true
+	return len(p), nil
+}
+
+// Truncate changes the size of the content written to f, as if the
+// content is written.
+func (f *writableFile) Truncate(size int64) error {
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty && f.buf == nil {
+		if err := f.load(); err != nil {
+			return err
+		}
+		f.buf = bytes.Clone(f.content)
+	}
+	if size <= int64(len(f.buf)) {
+		f.buf = f.buf[:size]
+	} else {
+		f.buf = append(f.buf, make([]byte, size-int64(len(f.buf)))...)
+	}
+	f.dirty = true
+	return nil
+}
+
+// Seek sets the offset of Read and Write. It reads the content to seek
+// from the end if the content is not read yet.
+func (f *writableFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		if !f.dirty && f.buf == nil {
+			if err := f.load(); err != nil {
+				return 0, err
 			}
 		}
-		r.CloseWithError(s.Err())
-	}()
-	return &ctlFile{name: base, w: w, done: done}
+		offset += int64(len(f.data()))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *writableFile) Write(p []byte) (int, error) {
+	if f.append {
+		f.mu.Lock()
+		f.off = int64(len(f.buf))
+		f.mu.Unlock()
+	}
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *writableFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return nil
+	}
+	f.dirty = false
+	if err := f.write(f.buf); err != nil {
+		return &fs.PathError{Op: "write", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+func CtlFile(fn func(s string) error) File {
+	return CtlFileUsage("", fn)
+}
+
+// CtlFileUsage is like CtlFile but the file is readable. Reading it returns
+// usage, which should list the commands accepted by fn one per line, and
+// the result of the last command written to the same open file. Commands
+// are run as soon as their lines are written; the error of a failed
+// command is returned by that Write and by Close, and stops the following
+// commands.
+func CtlFileUsage(usage string, fn func(s string) error) File {
+	if usage != "" && !strings.HasSuffix(usage, "\n") {
+		usage += "\n"
+	}
+	return func(o *openArgs) (fs.File, error) {
+		return &ctlFile{name: o.base(), usage: usage, fn: fn}, nil
+	}
+}
+
+type ctlFile struct {
+	name  string
+	usage string
+	fn    func(s string) error
+
+	mu   sync.Mutex
+	buf  []byte // incomplete line
+	last string // result of the last command
+	err  error  // first error, which stops the following commands
+	off  int64  // offset of Read
 }
 
 func (f *ctlFile) Stat() (fs.FileInfo, error) {
-	return &fileInfo{name: f.name, mode: 0222}, nil
+	mode := fs.FileMode(0222)
+	if f.usage != "" {
+		mode |= 0444
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &fileInfo{name: f.name, mode: mode, size: int64(len(f.content()))}, nil
+}
+
+func (f *ctlFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.buf = append(f.buf, p...)
+	for {
+		i := bytes.IndexByte(f.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(f.buf[:i])
+		f.buf = f.buf[i+1:]
+		if !f.run(line) {
+			// Report the error to the writer, such as a 9P client
+			// which ignores the errors of clunk, as well as on Close.
+			return len(p), f.err
+		}
+	}
+	return len(p), nil
 }
-func (f *ctlFile) Write(p []byte) (int, error) { return f.w.Write(p) }
+
+// run runs the command s. It reports whether the command succeeds.
+// The result records only the verb of s, since the arguments may be
+// secrets such as API keys.
+func (f *ctlFile) run(s string) bool {
+	var verb string
+	if fields := strings.Fields(s); len(fields) > 0 {
+		verb = fields[0]
+	}
+	if err := f.fn(s); err != nil {
+		f.last = verb + ": " + err.Error()
+		f.err = &fs.PathError{Op: "write", Path: f.name, Err: err}
+		return false
+	}
+	if verb != "" {
+		f.last = verb + ": ok"
+	}
+	return true
+}
+
 func (f *ctlFile) Close() error {
-	err := f.w.Close()
-	<-f.done
-	return err
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil && len(f.buf) > 0 {
+		f.run(string(f.buf))
+	}
+	f.buf = nil
+	return f.err
+}
+
+func (f *ctlFile) content() []byte {
+	b := []byte(f.usage)
+	if f.last != "" {
+		b = append(b, "last: "+f.last+"\n"...)
+	}
+	return b
+}
+
+func (f *ctlFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return bytes.NewReader(f.content()).ReadAt(p, off)
+}
+
+// Seek sets the offset of Read.
+func (f *ctlFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.content()))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *ctlFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
 }
-func (f *ctlFile) Read(_ []byte) (int, error) { return 0, io.EOF }
@@ -2,9 +2,15 @@ package muxfs
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCtlFile(t *testing.T) {
@@ -38,3 +44,187 @@ got: %q
 expected: %q`, got, msg)
 	}
 }
+
+func TestCtlFileError(t *testing.T) {
+	errBad := errors.New("bad command")
+	file := CtlFile(func(s string) error {
+		if s == "bad" {
+			return errBad
+		}
+		return nil
+	})
+	f, err := file(&openArgs{})
+	if err != nil {
+		t.Fatalf("failed on open: %v", err)
+	}
+	writer := f.(io.WriteCloser)
+	if _, err := io.WriteString(writer, "good\n"); err != nil {
+		t.Fatalf("failed on write: %v", err)
+	}
+	if _, err := io.WriteString(writer, "bad\n"); !errors.Is(err, errBad) {
+		t.Errorf("Write of a failing command returns %v, want %v", err, errBad)
+	}
+	if err := writer.Close(); !errors.Is(err, errBad) {
+		t.Errorf("Close returns %v, want %v", err, errBad)
+	}
+}
+
+func TestCtlFileUsage(t *testing.T) {
+	file := CtlFileUsage("reload\nquit", func(s string) error {
+		if s == "bad" {
+			return errors.New("bad command")
+		}
+		return nil
+	})
+	f, err := file(&openArgs{})
+	if err != nil {
+		t.Fatalf("failed on open: %v", err)
+	}
+	read := func() string {
+		t.Helper()
+		b := make([]byte, 100)
+		n, err := f.(io.ReaderAt).ReadAt(b, 0)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+
+	if got, want := read(), "reload\nquit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := io.WriteString(f.(io.Writer), "reload secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(), "reload\nquit\nlast: reload: ok\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if info, err := f.Stat(); err != nil || info.Size() != int64(len(read())) {
+		t.Errorf("Stat returns %v, %v, want the size of the content", info, err)
+	}
+	io.WriteString(f.(io.Writer), "bad\n")
+	if got, want := read(), "reload\nquit\nlast: bad: bad command\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := f.Close(); err == nil {
+		t.Error("Close does not report the failed command")
+	}
+}
+
+func TestWritableFile(t *testing.T) {
+	content := "old\n"
+	var written []string
+	file := WritableFile(func() (io.Reader, time.Time, error) {
+		return strings.NewReader(content), time.Time{}, nil
+	}, func(b []byte) error {
+		written = append(written, string(b))
+		return nil
+	})
+
+	for _, tt := range []struct {
+		flag  int
+		write string
+		read  string
+		want  []string
+	}{
+		{flag: os.O_RDONLY, read: "old\n"},
+		{flag: os.O_WRONLY, write: "new\n", want: []string{"new\n"}},
+		{flag: os.O_RDWR, write: "n", read: "nld\n", want: []string{"nld\n"}},
+		{flag: os.O_RDWR | os.O_TRUNC, write: "n", read: "n", want: []string{"n"}},
+		{flag: os.O_WRONLY | os.O_TRUNC, want: []string{""}},
+		{flag: os.O_WRONLY | os.O_APPEND, write: "new\n", read: "old\nnew\n", want: []string{"old\nnew\n"}},
+		{flag: os.O_RDWR | os.O_APPEND, write: "new\n", read: "old\nnew\n", want: []string{"old\nnew\n"}},
+	} {
+		written = nil
+		f, err := file(&openArgs{name: "f", flag: tt.flag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.write != "" {
+			if _, err := io.WriteString(f.(io.Writer), tt.write); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := make([]byte, 10)
+		n, _ := f.(io.ReaderAt).ReadAt(b, 0)
+		if tt.flag != os.O_WRONLY && string(b[:n]) != tt.read {
+			t.Errorf("flag %#x: read %q, want %q", tt.flag, b[:n], tt.read)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(written, tt.want) {
+			t.Errorf("flag %#x: written %q, want %q", tt.flag, written, tt.want)
+		}
+	}
+
+	errBad := errors.New("bad content")
+	file = WritableFile(nil, func(b []byte) error { return errBad })
+	f, err := file(&openArgs{name: "f", flag: os.O_WRONLY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f.(io.Writer), "bad")
+	if err := f.Close(); !errors.Is(err, errBad) {
+		t.Errorf("Close returns %v, want %v", err, errBad)
+	}
+}
+
+func TestLazyWritableFile(t *testing.T) {
+	var reads int
+	file := LazyWritableFile(func() (int64, time.Time) {
+		return 4, time.Time{}
+	}, func() (io.Reader, time.Time, error) {
+		reads++
+		return strings.NewReader("new content\n"), time.Time{}, nil
+	}, func(b []byte) error { return nil })
+
+	f, err := file(&openArgs{name: "f", flag: os.O_RDONLY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() != 4 {
+		t.Errorf("Stat returns %v, %v, want the size by stat", info, err)
+	}
+	if reads != 0 {
+		t.Errorf("open and Stat read %d times, want 0", reads)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "new content\n" || reads != 1 {
+		t.Errorf("read %q with %d reads, want the content with 1 read", b, reads)
+	}
+	if info, err := f.Stat(); err != nil || info.Size() != int64(len(b)) {
+		t.Errorf("Stat after read returns %v, %v, want the size of the content", info, err)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	m := NewFS()
+	m.File("roles", WritableFile(func() (io.Reader, time.Time, error) {
+		return strings.NewReader("web:app\n"), time.Time{}, nil
+	}, func(b []byte) error { return nil }))
+	m.File("memo", LazyWritableFile(func() (int64, time.Time) {
+		return int64(len("looking\n")), time.Time{}
+	}, func() (io.Reader, time.Time, error) {
+		return strings.NewReader("looking\n"), time.Time{}, nil
+	}, func(b []byte) error { return nil }))
+	m.File("ctl", CtlFileUsage("reload", func(s string) error { return nil }))
+	h := http.FileServer(http.FS(m))
+
+	// http.FileServer fails to serve a file which is not an io.Seeker.
+	for name, want := range map[string]string{
+		"roles": "web:app\n",
+		"memo":  "looking\n",
+		"ctl":   "reload\n",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET /%s returns %d %q, want %q", name, w.Code, w.Body, want)
+		}
+	}
+}
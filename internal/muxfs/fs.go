@@ -6,7 +6,9 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/rmatsuoka/mackerelfs/internal/extfs"
 )
@@ -18,15 +20,53 @@ type VarFS interface {
 	All() (Seq[string], error)
 }
 
+// StatVarFS is a VarFS which can describe its file systems without opening
+// them. Stat(base) must agree with fs.Stat(fsys, ".") for the file system
+// fsys returned by FS(base), except for the name.
+type StatVarFS interface {
+	VarFS
+	Stat(base string) (fs.FileInfo, error)
+}
+
+// MkdirVarFS is a VarFS in which directories can be made. Mkdir(base)
+// makes the file system which FS(base) returns afterwards.
+type MkdirVarFS interface {
+	VarFS
+	Mkdir(base string, perm fs.FileMode) error
+}
+
+// RemoveVarFS is a VarFS whose file systems can be removed. After
+// Remove(base) succeeds, FS(base) no longer returns the file system.
+type RemoveVarFS interface {
+	VarFS
+	Remove(base string) error
+}
+
+// DirInfo returns the fs.FileInfo of a directory served by FS, for
+// implementations of StatVarFS.
+func DirInfo(name string, modTime time.Time) fs.FileInfo {
+	return fileInfo{name: name, mode: fs.ModeDir | 0555, modTime: modTime}
+}
+
+// FileInfo returns the fs.FileInfo of a file, for the files opened by
+// FuncFile.
+func FileInfo(name string, mode fs.FileMode, size int64, modTime time.Time) fs.FileInfo {
+	return fileInfo{name: name, mode: mode, size: size, modTime: modTime}
+}
+
 type FS struct {
-	files map[string]File
-	fs    map[string]fs.FS
-	varFS VarFS
+	files        map[string]File
+	pipes        map[string]bool // files added by Pipe
+	fs           map[string]fs.FS
+	varFS        VarFS
+	modTime      func() time.Time
+	ignoreRemove bool
 }
 
 func NewFS() *FS {
 	return &FS{
 		files: make(map[string]File),
+		pipes: make(map[string]bool),
 		fs:    make(map[string]fs.FS),
 	}
 }
@@ -44,6 +84,31 @@ func (fsys *FS) VarFS(c VarFS) {
 	fsys.varFS = c
 }
 
+// ModTime sets the function reporting the modification time of the root
+// directory of fsys.
+func (fsys *FS) ModTime(f func() time.Time) {
+	fsys.modTime = f
+}
+
+// Info returns the fs.FileInfo of the root directory of fsys with the
+// name. Unlike fs.Stat(fsys, "."), it does not list the directory, so that
+// a StatVarFS can describe fsys without loading it.
+func (fsys *FS) Info(name string) fs.FileInfo {
+	var modTime time.Time
+	if fsys.modTime != nil {
+		modTime = fsys.modTime()
+	}
+	return DirInfo(name, modTime)
+}
+
+// IgnoreRemove makes removing any file in fsys succeed without effect.
+// It is for a directory which is removed as a whole, such as by its
+// parent RemoveVarFS, since rm -r removes the files in a directory before
+// the directory itself and gives up if it cannot.
+func (fsys *FS) IgnoreRemove() {
+	fsys.ignoreRemove = true
+}
+
 type openArgs struct {
 	name string
 	flag int
@@ -59,6 +124,15 @@ func (fsys *FS) File(base string, f File) {
 	fsys.files[base] = f
 }
 
+// Pipe is like File but the file is listed as a named pipe, for a file
+// whose reads block until something happens, such as a feed of events.
+// Recursive readers such as grep -r skip named pipes. The file should
+// report fs.ModeNamedPipe in its Stat.
+func (fsys *FS) Pipe(base string, f File) {
+	fsys.File(base, f)
+	fsys.pipes[base] = true
+}
+
 func firstNode(path string) string {
 	i := strings.IndexByte(path, '/')
 	if i == -1 {
@@ -70,7 +144,14 @@ func firstNode(path string) string {
 func (fsys *FS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
 	if name == "." {
 		ents, err := fsys.rootEnts()
-		return &root{ents: ents}, err
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		r := &root{ents: ents}
+		if fsys.modTime != nil {
+			r.modTime = fsys.modTime()
+		}
+		return r, nil
 	}
 
 	open, err := fsys.lookup(name)
@@ -84,11 +165,78 @@ func (fsys *FS) Open(name string) (fs.File, error) {
 	return fsys.OpenFile(name, os.O_RDONLY, 0)
 }
 
+// Mkdir makes the directory name. The directories at the root of fsys are
+// made by its VarFS, which must implement MkdirVarFS; the others are made
+// by the file systems containing them, through extfs.Mkdir.
+func (fsys *FS) Mkdir(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := firstNode(name)
+	if prefix != name {
+		f, err := fsys.lookupFS(prefix)
+		if err != nil {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+		return fixError(extfs.Mkdir(f, stripPrefix(name, prefix), perm), name)
+	}
+	if _, err := fsys.lookup(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	m, ok := fsys.varFS.(MkdirVarFS)
+	if !ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: extfs.ErrNotImplemented}
+	}
+	if err := m.Mkdir(name, perm); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Remove removes the file name. The file systems at the root of fsys are
+// removed by its VarFS, which must implement RemoveVarFS; the other files
+// are removed by the file systems containing them, through extfs.Remove.
+// The files added by File and FS cannot be removed.
+func (fsys *FS) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	if fsys.ignoreRemove {
+		_, err := fs.Stat(fsys, name)
+		return err
+	}
+	if _, err := fsys.lookup(name); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	prefix := firstNode(name)
+	if prefix != name {
+		f, err := fsys.lookupFS(prefix)
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		return fixError(extfs.Remove(f, stripPrefix(name, prefix)), name)
+	}
+	_, isFile := fsys.files[name]
+	_, isFS := fsys.fs[name]
+	r, ok := fsys.varFS.(RemoveVarFS)
+	if isFile || isFS || !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	if err := r.Remove(name); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
 func (fsys *FS) rootEnts() ([]fs.DirEntry, error) {
 	var ents []fs.DirEntry
 	for name, open := range fsys.files {
 		name := name
 		open := open
+		var typ fs.FileMode
+		if fsys.pipes[name] {
+			typ = fs.ModeNamedPipe
+		}
 		ents = append(ents, &rootDirEntry{
 			name: name,
 			info: func() (fs.FileInfo, error) {
@@ -100,9 +248,10 @@ func (fsys *FS) rootEnts() ([]fs.DirEntry, error) {
 				if err != nil {
 					return nil, err
 				}
+				defer f.Close()
 				return f.Stat()
 			},
-			typ: 0,
+			typ: typ,
 		})
 	}
 
@@ -111,10 +260,14 @@ func (fsys *FS) rootEnts() ([]fs.DirEntry, error) {
 		return nil, err
 	}
 
+	statFS, _ := fsys.varFS.(StatVarFS)
 	iter(func(name string) bool {
 		ents = append(ents, &rootDirEntry{
 			name: name,
 			info: func() (fs.FileInfo, error) {
+				if _, ok := fsys.fs[name]; !ok && statFS != nil {
+					return statFS.Stat(name)
+				}
 				f, err := fsys.lookupFS(name)
 				if err != nil {
 					return nil, err
@@ -130,6 +283,11 @@ func (fsys *FS) rootEnts() ([]fs.DirEntry, error) {
 		return true
 	})
 
+	// Directory reads are a snapshot sorted by name, so that clients see
+	// the same order on every read.
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].Name() < ents[j].Name()
+	})
 	return ents, nil
 }
 
@@ -232,7 +390,11 @@ func (f *fixedFile) ReadDir(n int) ([]fs.DirEntry, error) {
 	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: extfs.ErrNotImplemented}
 }
 
-var _ fs.ReadDirFile = &fixedFile{}
+var (
+	_ fs.ReadDirFile = &fixedFile{}
+	_ extfs.MkdirFS  = &FS{}
+	_ extfs.RemoveFS = &FS{}
+)
 
 func fixError(err error, name string) error {
 	var perr *fs.PathError
@@ -244,8 +406,9 @@ func fixError(err error, name string) error {
 }
 
 type root struct {
-	ents   []fs.DirEntry
-	offset int
+	ents    []fs.DirEntry
+	offset  int
+	modTime time.Time
 }
 
 func (r *root) Read(_ []byte) (int, error) {
@@ -253,7 +416,7 @@ func (r *root) Read(_ []byte) (int, error) {
 }
 
 func (r *root) Stat() (fs.FileInfo, error) {
-	return fileInfo{name: ".", mode: fs.ModeDir | 0555}, nil
+	return fileInfo{name: ".", mode: fs.ModeDir | 0555, modTime: r.modTime}, nil
 }
 
 func (r *root) ReadDir(n int) ([]fs.DirEntry, error) {
@@ -1,11 +1,15 @@
 package muxfs
 
 import (
+	"errors"
 	"io"
 	"io/fs"
 	"strings"
 	"testing"
 	"testing/fstest"
+	"time"
+
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
 )
 
 type mapChildren map[string]fs.FS
@@ -90,3 +94,152 @@ func TestFS(t *testing.T) {
 		}
 	})
 }
+
+type statChildren struct {
+	mapChildren
+	opened int
+}
+
+func (m *statChildren) FS(name string) (fs.FS, bool) {
+	m.opened++
+	return m.mapChildren.FS(name)
+}
+
+func (m *statChildren) Stat(name string) (fs.FileInfo, error) {
+	if _, ok := m.mapChildren[name]; !ok {
+		return nil, fs.ErrNotExist
+	}
+	return DirInfo(name, time.Time{}), nil
+}
+
+func TestReadDir(t *testing.T) {
+	f := NewFS()
+	m := &statChildren{mapChildren: make(mapChildren)}
+	for _, name := range []string{"c", "a", "e"} {
+		m.mapChildren[name] = fstest.MapFS{}
+	}
+	f.VarFS(m)
+	f.File("d", ReaderFile(func() (io.Reader, error) {
+		return strings.NewReader("hello"), nil
+	}))
+	f.FS("b", fstest.MapFS{})
+
+	d, err := f.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ents, err := d.(fs.ReadDirFile).ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+		if _, err := e.Info(); err != nil {
+			t.Error(err)
+		}
+	}
+	if got, want := strings.Join(names, " "), "a b c d e"; got != want {
+		t.Errorf("ReadDir returns %q, want %q", got, want)
+	}
+	if m.opened != 0 {
+		t.Errorf("Info opens StatVarFS %d times, want 0", m.opened)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	f := NewFS()
+	f.Pipe("events", ReaderFile(func() (io.Reader, error) {
+		return strings.NewReader(""), nil
+	}))
+	ents, err := fs.ReadDir(f, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Type() != fs.ModeNamedPipe {
+		t.Errorf("ReadDir returns %v, want a named pipe", ents)
+	}
+}
+
+type mkdirChildren struct {
+	mapChildren
+}
+
+func (m mkdirChildren) Mkdir(name string, perm fs.FileMode) error {
+	m.mapChildren[name] = NewFS()
+	return nil
+}
+
+func TestMkdir(t *testing.T) {
+	sub := NewFS()
+	sub.VarFS(mkdirChildren{make(mapChildren)})
+	f := NewFS()
+	f.FS("sub", sub)
+	f.File("file", ReaderFile(func() (io.Reader, error) {
+		return strings.NewReader("hello"), nil
+	}))
+
+	if err := f.Mkdir("sub/a", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat(f, "sub/a"); err != nil || !info.IsDir() {
+		t.Errorf("sub/a is not made: %v", err)
+	}
+	for name, want := range map[string]error{
+		"sub/a":   fs.ErrExist,
+		"file":    fs.ErrExist,
+		"sub":     fs.ErrExist,
+		"new":     extfs.ErrNotImplemented,
+		"file/a":  fs.ErrNotExist,
+		"sub/a/b": extfs.ErrNotImplemented,
+		"/bad":    fs.ErrInvalid,
+	} {
+		if err := f.Mkdir(name, 0777); !errors.Is(err, want) {
+			t.Errorf("Mkdir(%q) = %v, want %v", name, err, want)
+		}
+	}
+}
+
+type removeChildren struct {
+	mapChildren
+}
+
+func (m removeChildren) Remove(name string) error {
+	delete(m.mapChildren, name)
+	return nil
+}
+
+func TestRemove(t *testing.T) {
+	a := NewFS()
+	a.File("file", ReaderFile(func() (io.Reader, error) {
+		return strings.NewReader("hello"), nil
+	}))
+	a.IgnoreRemove()
+	sub := NewFS()
+	sub.VarFS(removeChildren{mapChildren{"a": a, "b": NewFS()}})
+	f := NewFS()
+	f.FS("sub", sub)
+
+	for name, want := range map[string]error{
+		"sub":         fs.ErrPermission,
+		"sub/c":       fs.ErrNotExist,
+		"sub/a/file":  nil,
+		"sub/a/other": fs.ErrNotExist,
+		"sub/b":       nil,
+		".":           fs.ErrInvalid,
+	} {
+		if err := f.Remove(name); !errors.Is(err, want) {
+			t.Errorf("Remove(%q) = %v, want %v", name, err, want)
+		}
+	}
+	if _, err := fs.Stat(f, "sub/a/file"); err != nil {
+		t.Errorf("ignored removal removes sub/a/file: %v", err)
+	}
+	if err := f.Remove("sub/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(f, "sub/a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("sub/a exists after removal: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Package replay records HTTP exchanges with the Mackerel API to a directory
+// and replays them later without network access.
+//
+// An exchange is identified by its method, path, query and request body,
+// except the query parameters holding times, such as the range of metrics,
+// which differ on every request. The host part of the URL and all request headers, including X-Api-Key,
+// are never written, so a recording can be replayed against any base URL
+// and with any API key.
+package replay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+type exchange struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Body   string      `json:"body,omitempty"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Resp   string      `json:"response"`
+}
+
+// Recorder is an http.RoundTripper which sends requests with Transport
+// and saves each exchange under Dir.
+type Recorder struct {
+	Dir string
+
+	// Transport is used to send requests.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	t := r.Transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	e := &exchange{
+		Method: req.Method,
+		URL:    req.URL.RequestURI(),
+		Body:   string(body),
+		Status: resp.StatusCode,
+		Header: header,
+		Resp:   string(b),
+	}
+	if err := r.save(e); err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return resp, nil
+}
+
+func (r *Recorder) save(e *exchange) error {
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(r.Dir, fileName(e.Method, e.URL, e.Body)), b, 0644)
+}
+
+// timeParams are the query parameters holding times, which are computed
+// from the current time by the clients, such as the from and to of metrics
+// and graph annotations.
+var timeParams = []string{"from", "to"}
+
+// exchangeKey returns uri without timeParams, so that an exchange recorded
+// at a time can be replayed later.
+func exchangeKey(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil || u.RawQuery == "" {
+		return uri
+	}
+	q := u.Query()
+	for _, p := range timeParams {
+		q.Del(p)
+	}
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// Replayer is an http.RoundTripper which answers requests with the exchanges
+// saved by a Recorder under Dir. It returns an error for a request which was
+// not recorded.
+type Replayer struct {
+	Dir string
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	uri := req.URL.RequestURI()
+	b, err := os.ReadFile(filepath.Join(r.Dir, fileName(req.Method, uri, string(body))))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("replay: no recorded response for %s %s", req.Method, uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e exchange
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("replay: %s %s: %w", req.Method, uri, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(e.Resp))),
+		ContentLength: int64(len(e.Resp)),
+		Request:       req,
+	}, nil
+}
+
+// readBody reads the body of req and rewinds it so that req can still be sent.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+func fileName(method, uri, body string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n%s", method, exchangeKey(uri), body)
+	return hex.EncodeToString(h.Sum(nil))[:32] + ".json"
+}
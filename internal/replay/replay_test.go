@@ -0,0 +1,93 @@
+package replay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/rmatsuoka/mackerelfs/internal/mackereltest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	const apikey = "secretapikey"
+	dir := t.TempDir()
+	srv := mackereltest.NewServer(&mackereltest.Fixture{
+		APIKey: apikey,
+		Org:    "testorg",
+		Hosts:  []*mackerel.Host{{ID: "host1", Name: "web01"}},
+		HostMetrics: map[string]map[string][]mackerel.MetricValue{
+			"host1": {"loadavg5": {{Time: 100, Value: 1.5}}},
+		},
+	})
+
+	rec := srv.NewClient()
+	rec.HTTPClient.Transport = &Recorder{Dir: dir}
+	if _, err := rec.GetOrg(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.FindHost("host1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.FetchHostMetricValues("host1", "loadavg5", 0, 200); err != nil {
+		t.Fatal(err)
+	}
+	_, err := rec.FindHost("nohost")
+	var apiErr *mackerel.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("FindHost(nohost) returns %v, want APIError", err)
+	}
+	srv.Close()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Errorf("recorded %d exchanges, want 4", len(files))
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), apikey) {
+			t.Errorf("%s contains the API key", f.Name())
+		}
+	}
+
+	play, _ := mackerel.NewClientWithOptions("otherkey", "http://replay.invalid/", false)
+	play.HTTPClient.Transport = &Replayer{Dir: dir}
+	org, err := play.GetOrg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org.Name != "testorg" {
+		t.Errorf("org name is %q, want testorg", org.Name)
+	}
+	host, err := play.FindHost("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Name != "web01" {
+		t.Errorf("host name is %q, want web01", host.Name)
+	}
+	// The range of metrics depends on when they are fetched.
+	values, err := play.FetchHostMetricValues("host1", "loadavg5", 1000, 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0].Value != 1.5 {
+		t.Errorf("replayed metrics are %+v", values)
+	}
+	_, err = play.FindHost("nohost")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 404 {
+		t.Errorf("replayed FindHost(nohost) returns %v, want 404 APIError", err)
+	}
+	if _, err := play.FindServices(); err == nil {
+		t.Error("FindServices succeeds without a recording")
+	}
+}
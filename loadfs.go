@@ -2,42 +2,113 @@ package mackerelfs
 
 import (
 	"io/fs"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
 )
 
 type Seq2[K, V any] func(yield func(K, V) bool)
 
-func itemFS(fetch func() (Seq2[string, fs.FS], error)) fs.FS {
+func itemFS(c *client, dir string, fetch func() (Seq2[string, fs.FS], error)) fs.FS {
+	m, _ := newItemFS(c, dir, fetch)
+	return m
+}
+
+// removableItemFS is like itemFS but removing a file system calls remove
+// with its name and then reloads the list, unless the organization is
+// read-only.
+func removableItemFS(c *client, dir string, fetch func() (Seq2[string, fs.FS], error), remove func(name string) error) fs.FS {
+	m, varFS := newItemFS(c, dir, fetch)
+	varFS.remove = func(name string) error {
+		if err := c.writable(); err != nil {
+			return err
+		}
+		return remove(name)
+	}
+	return m
+}
+
+func newItemFS(c *client, dir string, fetch func() (Seq2[string, fs.FS], error)) (*muxfs.FS, *itemVarFS) {
 	m := muxfs.NewFS()
-	varFS := &itemVarFS{fetch: fetch, m: make(map[string]fs.FS)}
+	varFS := newItemVarFS(c, dir, fetch)
 	m.VarFS(varFS)
-	m.File("ctl", muxfs.CtlFile(func(s string) error {
+	m.ModTime(varFS.modTime)
+	m.File("ctl", muxfs.CtlFileUsage("reload", func(s string) error {
 		f := strings.Fields(s)
 		if len(f) > 0 && f[0] == "reload" {
 			return varFS.reload()
 		}
 		return nil
 	}))
-	return m
+	return m, varFS
 }
 
-func newItemVarFS(fetch func() (Seq2[string, fs.FS], error)) *itemVarFS {
-	return &itemVarFS{fetch: fetch, m: make(map[string]fs.FS)}
+// newItemVarFS returns the itemVarFS of the directory dir, whose file
+// systems are listed by fetch.
+func newItemVarFS(c *client, dir string, fetch func() (Seq2[string, fs.FS], error)) *itemVarFS {
+	return &itemVarFS{fetch: fetch, stats: c.stats, dir: dir}
 }
 
+var (
+	_ muxfs.StatVarFS   = &itemVarFS{}
+	_ muxfs.RemoveVarFS = &itemVarFS{}
+)
+
 type itemVarFS struct {
-	fetch func() (Seq2[string, fs.FS], error)
-	m     map[string]fs.FS
+	fetch  func() (Seq2[string, fs.FS], error)
+	remove func(name string) error // nil if the items cannot be removed
+	expire func()                  // if non-nil, called on reload to expire a cache fetch uses
+	stats  *stats
+	dir    string
+
+	// loadMu serializes load across the fetch, so that an older fetch
+	// never replaces the file systems of a newer one.
+	loadMu sync.Mutex
+
+	mu     sync.Mutex
+	m      map[string]fs.FS // nil until loaded or invalidated; never modified once set
+	loaded time.Time
+}
+
+// modTime returns the time of the last reload.
+func (f *itemVarFS) modTime() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loaded
+}
+
+// items returns the loaded file systems, loading them if they are not yet.
+func (f *itemVarFS) items() (map[string]fs.FS, error) {
+	f.mu.Lock()
+	m := f.m
+	f.mu.Unlock()
+	f.stats.cache(m != nil)
+	if m != nil {
+		return m, nil
+	}
+	f.loadMu.Lock()
+	defer f.loadMu.Unlock()
+	// Another load may have finished while waiting for loadMu.
+	f.mu.Lock()
+	m = f.m
+	f.mu.Unlock()
+	if m != nil {
+		return m, nil
+	}
+	return f.loadLocked()
 }
 
 func (f *itemVarFS) All() (muxfs.Seq[string], error) {
-	if len(f.m) == 0 {
-		return nil, f.reload()
+	m, err := f.items()
+	if err != nil {
+		return nil, err
 	}
+	names := sortedKeys(m)
 	return func(yield func(string) bool) {
-		for k := range f.m {
+		for _, k := range names {
 			if !yield(k) {
 				return
 			}
@@ -46,25 +117,95 @@ func (f *itemVarFS) All() (muxfs.Seq[string], error) {
 }
 
 func (f *itemVarFS) FS(name string) (fs.FS, bool) {
-	if len(f.m) == 0 {
-		f.reload()
-	}
-	fsys, ok := f.m[name]
+	m, _ := f.items()
+	fsys, ok := m[name]
 	if !ok {
 		return nil, false
 	}
 	return fsys, true
 }
 
+// Stat describes the loaded file system of name without opening it.
+func (f *itemVarFS) Stat(name string) (fs.FileInfo, error) {
+	m, err := f.items()
+	if err != nil {
+		return nil, err
+	}
+	fsys, ok := m[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	if d, ok := fsys.(*muxfs.FS); ok {
+		return d.Info(name), nil
+	}
+	return muxfs.DirInfo(name, f.modTime()), nil
+}
+
+func (f *itemVarFS) Remove(name string) error {
+	if f.remove == nil {
+		return fs.ErrPermission
+	}
+	if _, ok := f.FS(name); !ok {
+		return fs.ErrNotExist
+	}
+	if err := f.remove(name); err != nil {
+		return fsError(err)
+	}
+	return f.reload()
+}
+
 func (f *itemVarFS) reload() error {
+	if f.expire != nil {
+		f.expire()
+	}
+	_, err := f.load()
+	return err
+}
+
+// invalidate discards the loaded file systems, so that they are loaded
+// again when they are used next. It waits for a load in progress, which
+// may have fetched them before a change.
+func (f *itemVarFS) invalidate() {
+	f.loadMu.Lock()
+	defer f.loadMu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.m = nil
+}
+
+func (f *itemVarFS) load() (map[string]fs.FS, error) {
+	f.loadMu.Lock()
+	defer f.loadMu.Unlock()
+	return f.loadLocked()
+}
+
+// loadLocked fetches the file systems and replaces the loaded ones.
+// f.loadMu must be held.
+func (f *itemVarFS) loadLocked() (map[string]fs.FS, error) {
 	iter, err := f.fetch()
 	if err != nil {
-		return err
+		return nil, fsError(err)
 	}
-	clear(f.m)
+	m := make(map[string]fs.FS)
 	iter(func(name string, fsys fs.FS) bool {
-		f.m[name] = fsys
+		m[name] = fsys
 		return true
 	})
-	return nil
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.m = m
+	f.loaded = time.Now()
+	f.stats.reload(f.dir, f.loaded)
+	return m, nil
+}
+
+// sortedKeys returns the keys of m in increasing order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
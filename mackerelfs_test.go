@@ -0,0 +1,1292 @@
+package mackerelfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/rmatsuoka/mackerelfs/internal/extfs"
+	"github.com/rmatsuoka/mackerelfs/internal/mackereltest"
+)
+
+// testLimits does not slow tests down nor hide errors by retries.
+var testLimits = Limits{Rate: 1e6, Burst: 1e6, Retries: -1}
+
+func testFixture() *mackereltest.Fixture {
+	now := time.Now().Unix()
+	return &mackereltest.Fixture{
+		APIKey: "testkey",
+		Org:    "testorg",
+		Hosts: []*mackerel.Host{
+			{
+				ID:        "host1",
+				Name:      "web01",
+				Status:    mackerel.HostStatusWorking,
+				Roles:     mackerel.Roles{"web": {"app"}},
+				CreatedAt: int32(now - 3600),
+			},
+			{
+				ID:        "host2",
+				Name:      "db01",
+				Status:    mackerel.HostStatusMaintenance,
+				Roles:     mackerel.Roles{"web": {"db"}},
+				CreatedAt: int32(now - 7200),
+			},
+		},
+		Services: []*mackerel.Service{
+			{Name: "web", Roles: []string{"app", "db"}},
+		},
+		Roles: map[string][]*mackerel.Role{
+			"web": {
+				{Name: "app", Memo: "application servers"},
+				{Name: "db", Memo: "database servers"},
+			},
+		},
+		HostMetrics: map[string]map[string][]mackerel.MetricValue{
+			"host1": {
+				"loadavg5": {
+					{Time: now - 120, Value: 0.5},
+					{Time: now - 60, Value: 1.5},
+				},
+			},
+			"host2": {
+				"loadavg5": {
+					{Time: now - 60, Value: 2.0},
+				},
+			},
+		},
+		ServiceMetrics: map[string]map[string][]mackerel.MetricValue{
+			"web": {
+				"requests": {
+					{Time: now - 60, Value: 100.0},
+				},
+			},
+		},
+	}
+}
+
+func newTestOrgFS(t *testing.T, f *mackereltest.Fixture) (fs.FS, *mackereltest.Server) {
+	t.Helper()
+	srv := mackereltest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c := newOrgClient(srv.NewClient(), testLimits)
+	c.pollInterval = 10 * time.Millisecond
+	name, fsys, err := orgFS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != f.Org {
+		t.Fatalf("org name is %q, want %q", name, f.Org)
+	}
+	return fsys, srv
+}
+
+// readLine reads a line of a feed in the background, so that the state
+// can be changed after the read starts polling it. It sends the error
+// message if the read fails.
+func readLine(f fs.File) <-chan string {
+	c := make(chan string, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		b := make([]byte, 512)
+		n, err := f.(interface {
+			ReadContext(context.Context, []byte) (int, error)
+		}).ReadContext(ctx, b)
+		if err != nil {
+			c <- err.Error()
+			return
+		}
+		c <- string(b[:n])
+	}()
+	return c
+}
+
+// testSubFS runs fstest.TestFS on the directory dir of fsys, which must
+// not contain feeds since fstest reads every file.
+func testSubFS(t *testing.T, fsys fs.FS, dir string, expected ...string) {
+	t.Helper()
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, expected...); err != nil {
+		t.Errorf("%s: %v", dir, err)
+	}
+}
+
+func TestOrgFS(t *testing.T) {
+	fsys, _ := newTestOrgFS(t, testFixture())
+	testSubFS(t, fsys, "hosts/web01", "info", "metrics/loadavg5/1hour")
+	testSubFS(t, fsys, "hosts/by-id", "host2/info")
+	testSubFS(t, fsys, "hosts/by-status", "working/web01/info")
+	testSubFS(t, fsys, "service",
+		"ctl",
+		"web/metrics/requests/1hour",
+		"web/app/memo",
+		"web/app/web01/info",
+		"web/db/db01/metrics/loadavg5/1hour",
+	)
+
+	// Recursive readers such as grep -r read the regular files and skip
+	// the feeds, which are named pipes.
+	var pipes []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().Type() != d.Type() {
+			t.Errorf("%s: Info has type %v, entry has %v", name, info.Mode().Type(), d.Type())
+		}
+		switch {
+		case d.Type() == fs.ModeNamedPipe:
+			pipes = append(pipes, name)
+		case d.Type().IsRegular():
+			if info.Mode()&0444 == 0 {
+				return nil
+			}
+			_, err := fs.ReadFile(fsys, name)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alerts/events", "hosts/changes"}; !slices.Equal(pipes, want) {
+		t.Errorf("named pipes are %v, want %v", pipes, want)
+	}
+}
+
+func TestHostInfo(t *testing.T) {
+	fsys, _ := newTestOrgFS(t, testFixture())
+	b, err := fs.ReadFile(fsys, "hosts/web01/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var host mackerel.Host
+	if err := json.Unmarshal(b, &host); err != nil {
+		t.Fatal(err)
+	}
+	if host.ID != "host1" || host.Name != "web01" {
+		t.Errorf("info describes %s (%s), want web01 (host1)", host.Name, host.ID)
+	}
+}
+
+func TestRoleMemo(t *testing.T) {
+	fsys, _ := newTestOrgFS(t, testFixture())
+	b, err := fs.ReadFile(fsys, "service/web/db/memo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "database servers"; got != want {
+		t.Errorf("memo is %q, want %q", got, want)
+	}
+}
+
+func TestMetricFile(t *testing.T) {
+	fsys, _ := newTestOrgFS(t, testFixture())
+	b, err := fs.ReadFile(fsys, "hosts/web01/metrics/loadavg5/1hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), b)
+	}
+	for i, want := range []string{"0.500000", "1.500000"} {
+		f := strings.Split(lines[i], "\t")
+		if len(f) != 3 || f[0] != "loadavg5" || f[1] != want {
+			t.Errorf("line %d is %q, want loadavg5\t%s\t<time>", i, lines[i], want)
+		}
+	}
+}
+
+func TestHostsReload(t *testing.T) {
+	fsys, srv := newTestOrgFS(t, testFixture())
+	if _, err := fs.Stat(fsys, "hosts/web02"); err == nil {
+		t.Fatal("hosts/web02 exists before it is added")
+	}
+	for _, name := range []string{"hosts/web01/info", "hosts/db01/info"} {
+		if _, err := fs.ReadFile(fsys, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.Update(func(f *mackereltest.Fixture) {
+		f.Hosts[1].Status = mackerel.HostStatusStandby
+		f.Hosts = append(f.Hosts, &mackerel.Host{ID: "host3", Name: "web02"})
+	})
+
+	if err := writeCtl(t, fsys, "hosts/ctl", "reload"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "hosts/web02"); err != nil {
+		t.Error(err)
+	}
+	// The reload keeps the loaded info of the unchanged host.
+	for _, name := range []string{"hosts/web01/info", "hosts/db01/info"} {
+		if _, err := fs.ReadFile(fsys, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, want := range map[string]int{"host1": 1, "host2": 2} {
+		if n := srv.Requests("GET", "/api/v0/hosts/"+id); n != want {
+			t.Errorf("%s is fetched %d times, want %d", id, n, want)
+		}
+	}
+}
+
+func writeCtl(t *testing.T, fsys fs.FS, name, s string) error {
+	t.Helper()
+	f, err := extfs.OpenFile(fsys, name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f.(io.Writer), s+"\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func TestRootCtl(t *testing.T) {
+	srv := mackereltest.NewServer(testFixture())
+	defer srv.Close()
+	fsys := NewFS(&Options{BaseURL: srv.URL, Limits: testLimits})
+
+	if err := writeCtl(t, fsys, "ctl", "new badkey"); err == nil {
+		t.Error("new with a wrong API key succeeds")
+	}
+	if err := writeCtl(t, fsys, "ctl", "new testkey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "testorg/hosts/web01/info"); err != nil {
+		t.Error(err)
+	}
+	if err := writeCtl(t, fsys, "ctl", "delete testorg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "testorg"); err == nil {
+		t.Error("testorg exists after delete")
+	}
+}
+
+func TestStat(t *testing.T) {
+	fixture := testFixture()
+	fsys, _ := newTestOrgFS(t, fixture)
+
+	for _, name := range []string{
+		"hosts/web01/info",
+		"hosts/web01/metrics/loadavg5/1hour",
+		"service/web/app/memo",
+	} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(b)) {
+			t.Errorf("%s: size is %d, want %d", name, info.Size(), len(b))
+		}
+		if info.ModTime().IsZero() {
+			t.Errorf("%s: modification time is zero", name)
+		}
+	}
+
+	info, err := fs.Stat(fsys, "hosts/web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.ModTime(), fixture.Hosts[0].DateFromCreatedAt(); !got.Equal(want) {
+		t.Errorf("hosts/web01: modification time is %v, want %v", got, want)
+	}
+
+	info, err = fs.Stat(fsys, "hosts/web01/metrics/loadavg5/1hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := fixture.HostMetrics["host1"]["loadavg5"]
+	if got, want := info.ModTime(), time.Unix(values[len(values)-1].Time, 0); !got.Equal(want) {
+		t.Errorf("1hour: modification time is %v, want %v", got, want)
+	}
+
+	if _, err := fs.ReadDir(fsys, "hosts"); err != nil {
+		t.Fatal(err)
+	}
+	info, err = fs.Stat(fsys, "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().IsZero() {
+		t.Error("hosts: modification time is zero after reload")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fsys, srv := newTestOrgFS(t, testFixture())
+	if _, err := fs.Stat(fsys, "hosts/web01"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Update(func(f *mackereltest.Fixture) {
+		f.Hosts = f.Hosts[1:]
+	})
+	_, err := fs.ReadFile(fsys, "hosts/web01/info")
+	var perr *fs.PathError
+	if !errors.As(err, &perr) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading info of a deleted host returns %v, want PathError of ErrNotExist", err)
+	}
+
+	if _, err := fs.Stat(fsys, "hosts/db01/metrics/loadavg5"); err != nil {
+		t.Fatal(err)
+	}
+	srv.FailNext(1, http.StatusTooManyRequests)
+	_, err = fs.ReadFile(fsys, "hosts/db01/metrics/loadavg5/1hour")
+	if !errors.As(err, &perr) || !errors.Is(err, ErrRateLimited) {
+		t.Errorf("rate limited read returns %v, want PathError of ErrRateLimited", err)
+	}
+
+	srv.FailNext(1, http.StatusForbidden)
+	err = writeCtl(t, fsys, "service/ctl", "reload")
+	if !errors.As(err, &perr) || !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("forbidden reload returns %v, want PathError of ErrPermission", err)
+	}
+
+	client := srv.NewClient()
+	client.APIKey = "badkey"
+	if _, _, err := orgFS(newOrgClient(client, testLimits)); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("orgFS with a wrong API key returns %v, want ErrPermission", err)
+	}
+}
+
+func TestReadDirInfo(t *testing.T) {
+	fsys, srv := newTestOrgFS(t, testFixture())
+	for _, dir := range []string{"service", "monitors", "hosts/by-service"} {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Name() != e.Name() || info.IsDir() != e.IsDir() {
+				t.Errorf("%s/%s: info is %s %v", dir, e.Name(), info.Name(), info.Mode())
+			}
+		}
+	}
+	// Opening service/web or hosts/by-service/web lists the roles.
+	if n := srv.Requests("GET", "/api/v0/services/web/roles"); n != 0 {
+		t.Errorf("roles are requested %d times, want 0", n)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	srv := mackereltest.NewServer(testFixture())
+	defer srv.Close()
+	fsys := NewFS(&Options{BaseURL: srv.URL, Limits: testLimits})
+	if err := writeCtl(t, fsys, "ctl", "new testkey"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"testorg/hosts/web01/info", "testorg/hosts/db01/info"} {
+		if _, err := fs.ReadFile(fsys, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := fs.ReadFile(fsys, "testorg/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := string(b)
+	for _, line := range []string{
+		"org=testorg\n",
+		"apikey=***tkey\n",
+		"calls.GET:/api/v0/org=1\n",
+		"calls.GET:/api/v0/hosts=1\n",
+		"calls.GET:/api/v0/hosts/*=2\n",
+		"errors=0\n",
+		"reload.hosts=",
+		"reload.hosts/web01=",
+	} {
+		if !strings.Contains(status, line) {
+			t.Errorf("status does not contain %q:\n%s", line, status)
+		}
+	}
+
+	b, err = fs.ReadFile(fsys, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"orgs=1\n", "org.testorg.calls=4\n"} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("global status does not contain %q:\n%s", line, b)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	fsys, _ := newTestOrgFS(t, testFixture())
+	srv := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer srv.Close()
+
+	for _, name := range []string{"hosts/web01/info", "hosts/web01/metrics/loadavg5/1hour", "service/web/app/memo"} {
+		want, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get(srv.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(b) != string(want) {
+			t.Errorf("GET %s: %s %q, want %q", name, resp.Status, b, want)
+		}
+	}
+}
+
+func TestOrgCache(t *testing.T) {
+	srv := mackereltest.NewServer(testFixture())
+	defer srv.Close()
+	cache := NewOrgCache()
+	opts := &Options{BaseURL: srv.URL, Limits: testLimits, Cache: cache}
+	a, b := NewFS(opts), NewFS(opts)
+
+	if err := writeCtl(t, a, "ctl", "new testkey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(b, "testorg"); err == nil {
+		t.Error("an organization registered by another file system is visible")
+	}
+	if err := writeCtl(t, b, "ctl", "new testkey"); err != nil {
+		t.Fatal(err)
+	}
+	for _, fsys := range []fs.FS{a, b} {
+		if _, err := fs.ReadFile(fsys, "testorg/hosts/web01/info"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.Requests("GET", "/api/v0/org"); n != 1 {
+		t.Errorf("GET /api/v0/org is requested %d times, want 1", n)
+	}
+	if n := srv.Requests("GET", "/api/v0/hosts"); n != 1 {
+		t.Errorf("GET /api/v0/hosts is requested %d times, want 1", n)
+	}
+
+	a.(io.Closer).Close()
+	if n := cache.len(); n != 1 {
+		t.Errorf("cache has %d organizations, want 1", n)
+	}
+	if err := writeCtl(t, b, "ctl", "delete testorg"); err != nil {
+		t.Fatal(err)
+	}
+	if n := cache.len(); n != 0 {
+		t.Errorf("cache has %d organizations after all are released, want 0", n)
+	}
+}
+
+func TestRootCtlAlias(t *testing.T) {
+	srv := mackereltest.NewServer(testFixture())
+	defer srv.Close()
+	fsys := NewFS(&Options{BaseURL: srv.URL, Limits: testLimits})
+
+	for _, tt := range []struct {
+		cmd string
+		ok  bool
+	}{
+		{"new testkey", true},
+		{"new testkey", false}, // testorg exists
+		{"new testkey as ro", true},
+		{"new testkey as ctl", false},
+		{"new testkey as a/b", false},
+		{"rename ro readonly", true},
+		{"rename readonly testorg", false},
+		{"rename nonexistent x", false},
+		{"delete nonexistent", false},
+		{"unknown", false},
+	} {
+		err := writeCtl(t, fsys, "ctl", tt.cmd)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q returns %v", tt.cmd, err)
+		}
+	}
+
+	b, err := fs.ReadFile(fsys, "orgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "readonly\ttestorg\treadonly\t" + srv.URL + "\n" +
+		"testorg\ttestorg\t-\t" + srv.URL + "\n"
+	if string(b) != want {
+		t.Errorf("orgs is\n%s\nwant\n%s", b, want)
+	}
+	if _, err := fs.Stat(fsys, "readonly/hosts/web01/info"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	srv := mackereltest.NewServer(testFixture())
+	defer srv.Close()
+	dir := t.TempDir()
+	name := dir + "/state.json"
+	opts := &Options{BaseURL: srv.URL, Limits: testLimits, StateFile: name}
+
+	fsys := NewFS(opts)
+	for _, cmd := range []string{"new testkey", "new testkey as ro", "rename ro readonly"} {
+		if err := writeCtl(t, fsys, "ctl", cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("state file permission is %v, want 0600", perm)
+	}
+
+	fsys = NewFS(opts)
+	for _, name := range []string{"testorg/hosts/web01/info", "readonly/hosts/web01/info"} {
+		if _, err := fs.Stat(fsys, name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// An entry which cannot be registered is kept.
+	t.Setenv("TEST_MACKEREL_APIKEY", "testkey")
+	err = os.WriteFile(name, []byte(`{"orgs":[
+		{"org":"testorg","apikeyRef":"env:TEST_MACKEREL_APIKEY"},
+		{"org":"testorg","alias":"bad","apikey":"badkey"}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys = NewFS(opts)
+	if _, err := fs.Stat(fsys, "testorg/hosts/web01/info"); err != nil {
+		t.Error(err)
+	}
+	b, err := fs.ReadFile(fsys, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "state.pending.bad=") {
+		t.Errorf("status does not report the pending entry:\n%s", b)
+	}
+	if err := writeCtl(t, fsys, "ctl", "new testkey as other"); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"env:TEST_MACKEREL_APIKEY"`, `"badkey"`, `"other"`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("state file does not contain %s:\n%s", s, b)
+		}
+	}
+}
+
+func TestHostsByID(t *testing.T) {
+	fixture := testFixture()
+	fixture.Hosts = append(fixture.Hosts, &mackerel.Host{
+		ID:     "host3",
+		Name:   "web01",
+		Status: mackerel.HostStatusWorking,
+		Roles:  mackerel.Roles{"web": {"app"}},
+	}, &mackerel.Host{
+		ID:     "host4",
+		Name:   "by-id",
+		Status: mackerel.HostStatusWorking,
+		Roles:  mackerel.Roles{"web": {"app"}},
+	})
+	fsys, _ := newTestOrgFS(t, fixture)
+
+	for dir, want := range map[string][]string{
+		"hosts":           {"by-id", "by-id@host4", "by-service", "by-status", "changes", "ctl", "db01", "web01@host1", "web01@host3"},
+		"hosts/by-id":     {"host1", "host2", "host3", "host4"},
+		"service/web/app": {"by-id@host4", "ctl", "memo", "web01@host1", "web01@host3"},
+	} {
+		ents, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("%s lists %v, want %v", dir, names, want)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"hosts/by-id/host3/id": "host3\n",
+		"hosts/web01@host1/id": "host1\n",
+		"hosts/db01/id":        "host2\n",
+		"hosts/by-id@host4/id": "host4\n",
+	} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is %q, want %q", name, b, want)
+		}
+	}
+	testSubFS(t, fsys, "hosts/by-id", "host2/info")
+}
+
+func TestHostsFiltered(t *testing.T) {
+	fsys, srv := newTestOrgFS(t, testFixture())
+
+	for dir, want := range map[string][]string{
+		"hosts/by-status":             {"maintenance", "poweroff", "standby", "working"},
+		"hosts/by-status/working":     {"ctl", "web01"},
+		"hosts/by-status/maintenance": {"ctl", "db01"},
+		"hosts/by-status/poweroff":    {"ctl"},
+		"hosts/by-service":            {"ctl", "web"},
+		"hosts/by-service/web":        {"app", "ctl", "db"},
+		"hosts/by-service/web/db":     {"ctl", "db01"},
+	} {
+		ents, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("%s lists %v, want %v", dir, names, want)
+		}
+	}
+	if n := srv.Requests("GET", "/api/v0/hosts"); n != 4 {
+		t.Errorf("GET /api/v0/hosts is requested %d times, want 4", n)
+	}
+	b, err := fs.ReadFile(fsys, "hosts/by-status/maintenance/db01/id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "host2\n" {
+		t.Errorf("hosts/by-status/maintenance/db01/id is %q, want %q", b, "host2\n")
+	}
+}
+
+func TestHostFields(t *testing.T) {
+	fixture := testFixture()
+	h := fixture.Hosts[0]
+	h.DisplayName = "Web 01"
+	h.Roles = mackerel.Roles{"web": {"app"}, "batch": {"worker"}}
+	h.CreatedAt = 1700000000
+	h.Interfaces = []mackerel.Interface{
+		{Name: "eth0", IPv4Addresses: []string{"10.0.0.1"}, IPv6Addresses: []string{"fe80::1"}},
+		{Name: "eth1", IPAddress: "192.168.0.1"},
+	}
+	h.Meta = mackerel.HostMeta{
+		AgentVersion: "0.78.0",
+		Kernel:       mackerel.Kernel{"name": "Linux", "release": "6.1.0"},
+		Memory:       mackerel.Memory{"total": "8000000kB"},
+		CPU:          mackerel.CPU{{"model_name": "Xeon"}, {"model_name": "Xeon"}},
+	}
+	fsys, srv := newTestOrgFS(t, fixture)
+
+	for name, want := range map[string]string{
+		"name":         "web01\n",
+		"displayName":  "Web 01\n",
+		"status":       "working\n",
+		"memo":         "",
+		"roles":        "batch:worker\nweb:app\n",
+		"ipaddrs":      "eth0\t10.0.0.1\neth0\tfe80::1\neth1\t192.168.0.1\n",
+		"createdAt":    "2023-11-14T22:13:20Z\n",
+		"retiredAt":    "",
+		"agentVersion": "0.78.0\n",
+		"kernel":       "name=Linux\nrelease=6.1.0\n",
+		"cpu":          "0.model_name=Xeon\n1.model_name=Xeon\n",
+		"memory":       "total=8000000kB\n",
+	} {
+		b, err := fs.ReadFile(fsys, "hosts/by-id/host1/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is %q, want %q", name, b, want)
+		}
+	}
+	if n := srv.Requests("GET", "/api/v0/hosts/host1"); n != 1 {
+		t.Errorf("GET /api/v0/hosts/host1 is requested %d times, want 1", n)
+	}
+}
+
+func TestMkdirHost(t *testing.T) {
+	fsys, srv := newTestOrgFS(t, testFixture())
+
+	if err := extfs.Mkdir(fsys, "hosts/newbox", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := extfs.Mkdir(fsys, "hosts/newbox", 0755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("mkdir of an existing host returns %v, want %v", err, fs.ErrExist)
+	}
+	if err := extfs.Mkdir(fsys, "hosts/by-id/newbox", 0755); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("mkdir in by-id returns %v, want %v", err, fs.ErrPermission)
+	}
+	if err := writeCtl(t, fsys, "hosts/newbox/roles", "web:app batch:worker"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCtl(t, fsys, "hosts/newbox/meta", `{"agent-version": "0.78.0", "memory": {"total": "8000000kB"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCtl(t, fsys, "hosts/newbox/meta", "{"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("writing broken meta returns %v, want %v", err, fs.ErrInvalid)
+	}
+
+	for name, want := range map[string]string{
+		"hosts/newbox/name":         "newbox\n",
+		"hosts/newbox/roles":        "batch:worker\nweb:app\n",
+		"hosts/newbox/agentVersion": "0.78.0\n",
+		"hosts/newbox/memory":       "total=8000000kB\n",
+	} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is %q, want %q", name, b, want)
+		}
+	}
+	srv.Update(func(f *mackereltest.Fixture) {
+		h := f.Hosts[len(f.Hosts)-1]
+		if h.Name != "newbox" || h.Meta.AgentVersion != "0.78.0" || len(h.Roles["web"]) != 1 {
+			t.Errorf("registered host is %+v", h)
+		}
+	})
+}
+
+func TestRemove(t *testing.T) {
+	fixture := testFixture()
+	now := time.Now().Unix()
+	fixture.Monitors = []mackerel.Monitor{
+		&mackerel.MonitorConnectivity{ID: "mon1", Name: "connectivity", Type: "connectivity"},
+		&mackerel.MonitorHostMetric{ID: "mon2", Name: "loadavg", Type: "host", Metric: "loadavg5"},
+	}
+	fixture.GraphAnnotations = []*mackerel.GraphAnnotation{
+		{ID: "ann1", Title: "deploy", Service: "web", From: now - 600, To: now - 300},
+	}
+	fsys, _ := newTestOrgFS(t, fixture)
+
+	for dir, want := range map[string][]string{
+		"monitors":                     {"ctl", "mon1", "mon2"},
+		"service/web/annotations":      {"ann1", "ctl"},
+		"service/web/annotations/ann1": {"description", "from", "info", "roles", "title", "to"},
+	} {
+		ents, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("%s lists %v, want %v", dir, names, want)
+		}
+	}
+	if b, err := fs.ReadFile(fsys, "monitors/mon2/name"); err != nil || string(b) != "loadavg\n" {
+		t.Errorf("monitors/mon2/name is %q, %v", b, err)
+	}
+	// Load the views of db01, which its removal must discard.
+	for _, name := range []string{"hosts/by-status/maintenance/db01", "hosts/by-service/web/db/db01"} {
+		if _, err := fs.Stat(fsys, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// rm -r removes the files in a directory before the directory.
+	for _, name := range []string{"hosts/db01/info", "hosts/db01/metrics/loadavg5", "hosts/db01", "monitors/mon1/info", "monitors/mon1", "service/web/annotations/ann1"} {
+		if err := extfs.Remove(fsys, name); err != nil {
+			t.Errorf("remove %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"hosts/db01", "hosts/by-id/host2", "hosts/by-status/maintenance/db01", "hosts/by-service/web/db/db01", "monitors/mon1", "service/web/annotations/ann1"} {
+		if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s exists after removal: %v", name, err)
+		}
+	}
+	for _, name := range []string{"hosts/ctl", "hosts/by-status", "service/web", "monitors/mon3"} {
+		if err := extfs.Remove(fsys, name); err == nil {
+			t.Errorf("remove %s succeeds", name)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fixture := testFixture()
+	fixture.Alerts = []*mackerel.Alert{{ID: "alert1", Status: "CRITICAL", HostID: "host1"}}
+	srv := mackereltest.NewServer(fixture)
+	defer srv.Close()
+	fsys := NewFS(&Options{BaseURL: srv.URL, Limits: testLimits, ReadOnly: true})
+	if err := writeCtl(t, fsys, "ctl", "new testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extfs.Mkdir(fsys, "testorg/hosts/newbox", 0755); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("mkdir returns %v, want %v", err, fs.ErrPermission)
+	}
+	if err := extfs.Remove(fsys, "testorg/hosts/web01"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("remove returns %v, want %v", err, fs.ErrPermission)
+	}
+	if err := writeCtl(t, fsys, "testorg/hosts/web01/roles", "web:db"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("writing roles returns %v, want %v", err, fs.ErrPermission)
+	}
+	if err := writeCtl(t, fsys, "testorg/alerts/alert1/memo", "memo"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("writing memo returns %v, want %v", err, fs.ErrPermission)
+	}
+	if n := srv.Requests("POST", "/api/v0/hosts/host1/retire"); n != 0 {
+		t.Errorf("retire is requested %d times", n)
+	}
+}
+
+func TestHostMetaSystem(t *testing.T) {
+	fixture := testFixture()
+	fixture.Hosts[0].Meta = mackerel.HostMeta{
+		AgentVersion: "0.78.0",
+		Kernel:       mackerel.Kernel{"name": "Linux", "release": "6.1.0"},
+		Memory:       mackerel.Memory{"total": "8000000kB"},
+		CPU:          mackerel.CPU{{"model_name": "Xeon", "mhz": 2400.0}, {"model_name": "Xeon", "mhz": 2400.0}},
+		BlockDevice:  mackerel.BlockDevice{"xvda": {"size": "16777216", "removable": "0"}},
+		Filesystem: mackerel.FileSystem{
+			"/dev/xvda1": map[string]any{"kb_size": 8123812.0, "mount": "/"},
+			"/dev/xvdb":  map[string]any{"kb_size": 1024.0},
+		},
+		Cloud: &mackerel.Cloud{Provider: "ec2", MetaData: map[string]any{"instance-id": "i-0123"}},
+	}
+	fsys, _ := newTestOrgFS(t, fixture)
+
+	for name, want := range map[string]string{
+		"kernel/release":           "6.1.0\n",
+		"memory/total":             "8000000kB\n",
+		"agent/version":            "0.78.0\n",
+		"cpu/1":                    "mhz=2400\nmodel_name=Xeon\n",
+		"block_device/xvda":        "removable=0\nsize=16777216\n",
+		"filesystem/%2F":           "kb_size=8123812\nmount=/\n",
+		"filesystem/%2Fdev%2Fxvdb": "kb_size=1024\n",
+		"cloud/provider":           "ec2\n",
+		"cloud/metadata":           "{\n  \"instance-id\": \"i-0123\"\n}\n",
+	} {
+		b, err := fs.ReadFile(fsys, "hosts/web01/meta-system/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is %q, want %q", name, b, want)
+		}
+	}
+	testSubFS(t, fsys, "hosts/db01", "meta-system/kernel")
+}
+
+func TestAlertEvents(t *testing.T) {
+	now := time.Now().Unix()
+	fixture := testFixture()
+	fixture.Monitors = []mackerel.Monitor{
+		&mackerel.MonitorConnectivity{ID: "mon1", Name: "connectivity", Type: "connectivity"},
+	}
+	fixture.Alerts = []*mackerel.Alert{
+		{ID: "alert1", Status: "CRITICAL", MonitorID: "mon1", Type: "connectivity", HostID: "host2", OpenedAt: now - 60},
+	}
+	fsys, srv := newTestOrgFS(t, fixture)
+
+	if _, err := extfs.OpenFile(fsys, "alerts/events", os.O_WRONLY, 0); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("open for writing returns %v, want %v", err, fs.ErrPermission)
+	}
+	clone, app := cloneFilter(t, fsys)
+	defer clone.Close()
+	if err := writeCtl(t, fsys, app+"/ctl", "role web:app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCtl(t, fsys, app+"/ctl", "unknown"); err == nil {
+		t.Error("writing an unknown command succeeds")
+	}
+	f, err := fsys.Open(app + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	all, err := fsys.Open("alerts/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	read := func() <-chan string { return readLine(f) }
+
+	if n := srv.Requests("GET", "/api/v0/alerts"); n != 0 {
+		t.Errorf("alerts are requested %d times before read", n)
+	}
+	line := read()
+	allLine := readLine(all)
+	// The first poll has been answered when the second is requested.
+	for srv.Requests("GET", "/api/v0/alerts") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Update(func(f *mackereltest.Fixture) {
+		f.Alerts[0].Status = "OK"
+		f.Alerts[0].ClosedAt = now
+		f.Alerts = append(f.Alerts, &mackerel.Alert{
+			ID: "alert2", Status: "CRITICAL", MonitorID: "mon1", Type: "connectivity", HostID: "host1",
+			Message: "no\nresponse", OpenedAt: now,
+		})
+	})
+	want := time.Unix(now, 0).UTC().Format(time.RFC3339) + "\tCRITICAL\talert2\tconnectivity\tweb01\tno response\n"
+	if got := <-line; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	// alerts/events reads also alert1 of db01, which is filtered out.
+	got := []string{<-allLine, <-readLine(all)}
+	slices.Sort(got)
+	if !strings.Contains(got[0], "\tCRITICAL\talert2\t") || !strings.Contains(got[1], "\tOK\talert1\t") {
+		t.Errorf("alerts/events reads %q, want alert1 closed and alert2 opened", got)
+	}
+
+	if err := writeCtl(t, fsys, app+"/ctl", "clear"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Update(func(f *mackereltest.Fixture) {
+		f.Alerts[1].Status = "OK"
+		f.Alerts[1].ClosedAt = now + 1
+	})
+	if got := <-read(); !strings.Contains(got, "\tOK\talert2\t") {
+		t.Errorf("read %q, want the alert closed", got)
+	}
+}
+
+// cloneFilter opens alerts/filters/clone and returns it with the
+// directory of the filter made by reading it.
+func cloneFilter(t *testing.T, fsys fs.FS) (fs.File, string) {
+	t.Helper()
+	f, err := fsys.Open("alerts/filters/clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f, "alerts/filters/" + strings.TrimSuffix(string(b), "\n")
+}
+
+func TestAlertFilters(t *testing.T) {
+	fsys, _ := newTestOrgFS(t, testFixture())
+	// Stating the clone file does not make a filter.
+	if _, err := fs.Stat(fsys, "alerts/filters/clone"); err != nil {
+		t.Fatal(err)
+	}
+	a, dirA := cloneFilter(t, fsys)
+	defer a.Close()
+	b, dirB := cloneFilter(t, fsys)
+	if dirA == dirB {
+		t.Errorf("clones make the same filter %s", dirA)
+	}
+	for dir, want := range map[string][]string{
+		"alerts/filters": {"1", "2", "clone"},
+		dirA:             {"ctl", "events"},
+	} {
+		ents, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("%s lists %v, want %v", dir, names, want)
+		}
+	}
+	if err := extfs.Mkdir(fsys, "alerts/filters/x", 0755); err == nil {
+		t.Error("mkdir in alerts/filters succeeds")
+	}
+
+	// Closing the clone file removes the filter.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, dirB); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s exists after the clone file is closed: %v", dirB, err)
+	}
+	if _, err := fs.Stat(fsys, dirA); err != nil {
+		t.Errorf("%s is removed with the other filter: %v", dirA, err)
+	}
+}
+
+func TestHostChanges(t *testing.T) {
+	fsys, srv := newTestOrgFS(t, testFixture())
+	if _, err := fs.ReadDir(fsys, "hosts"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := extfs.OpenFile(fsys, "hosts/changes", os.O_WRONLY, 0); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("open for writing returns %v, want %v", err, fs.ErrPermission)
+	}
+	f, err := fsys.Open("hosts/changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	line := readLine(f)
+	srv.Update(func(f *mackereltest.Fixture) {
+		f.Hosts[0].Status = mackerel.HostStatusStandby
+		f.Hosts[1].IsRetired = true
+		f.Hosts = append(f.Hosts, &mackerel.Host{ID: "host3", Name: "web05", Status: mackerel.HostStatusWorking})
+	})
+	got := []string{<-line, <-readLine(f), <-readLine(f)}
+	want := []string{
+		"- db01 retired\n",
+		"~ web01 status working->standby\n",
+		"+ web05\n",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	now := time.Now().Unix()
+	fixture := testFixture()
+	fixture.Monitors = []mackerel.Monitor{
+		&mackerel.MonitorConnectivity{ID: "mon1", Name: "connectivity", Type: "connectivity"},
+		&mackerel.MonitorServiceMetric{ID: "mon2", Name: "requests", Type: "service", Service: "web"},
+	}
+	fixture.Alerts = []*mackerel.Alert{
+		// open for longer than recentAlertsWindow
+		{ID: "alert1", Status: "CRITICAL", MonitorID: "mon1", HostID: "host1", OpenedAt: now - 40*24*3600},
+		{ID: "alert2", Status: "OK", MonitorID: "mon1", HostID: "host1", OpenedAt: now - 3600, ClosedAt: now - 60},
+		// closed before recentAlertsWindow
+		{ID: "alert3", Status: "OK", MonitorID: "mon1", HostID: "host2", OpenedAt: now - 10*24*3600, ClosedAt: now - 10*24*3600 + 60},
+		{ID: "alert4", Status: "WARNING", MonitorID: "mon2", OpenedAt: now - 600, Memo: "looking"},
+	}
+	fsys, _ := newTestOrgFS(t, fixture)
+
+	day := func(t int64) string { return time.Unix(t, 0).UTC().Format(time.DateOnly) }
+	for dir, want := range map[string][]string{
+		"alerts":                                  {"alert1", "alert4", "ctl", "events", "filters", "history"},
+		"hosts/web01/alerts":                      {"alert1", "alert2", "ctl"},
+		"hosts/db01/alerts":                       {"ctl"},
+		"service/web/alerts":                      {"alert1", "alert2", "alert4", "ctl"},
+		"alerts/history/" + day(now-10*24*3600):   {"alert3", "ctl"},
+		"alerts/history/" + day(now-40*24*3600+1): nil,
+	} {
+		entries, err := fs.ReadDir(fsys, dir)
+		if want == nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("reading %s returns %v, want %v", dir, err, fs.ErrNotExist)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("%s lists %v, want %v", dir, names, want)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"alerts/alert4/memo":                                 "looking\n",
+		"alerts/alert4/status":                               "WARNING\n",
+		"hosts/web01/alerts/alert2/closedAt":                 time.Unix(now-60, 0).UTC().Format(time.RFC3339) + "\n",
+		"alerts/history/" + day(now-3600) + "/alert2/status": "OK\n",
+	} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is %q, want %q", name, b, want)
+		}
+	}
+	var info mackerel.Alert
+	b, err := fs.ReadFile(fsys, "service/web/alerts/alert1/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "alert1" || info.HostID != "host1" {
+		t.Errorf("info is %+v", info)
+	}
+}
+
+func TestRecentAlerts(t *testing.T) {
+	now := time.Now().Unix()
+	fixture := testFixture()
+	fixture.Alerts = []*mackerel.Alert{
+		{ID: "alert1", Status: "CRITICAL", HostID: "host1", OpenedAt: now - 3600},
+	}
+	fsys, srv := newTestOrgFS(t, fixture)
+
+	// The alerts are fetched once for all the hosts and services.
+	for _, dir := range []string{"hosts/web01/alerts", "hosts/db01/alerts", "service/web/alerts"} {
+		if _, err := fs.ReadDir(fsys, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// findRecentAlerts requests the open alerts and the closed alerts.
+	if n := srv.Requests("GET", "/api/v0/alerts"); n != 2 {
+		t.Errorf("alerts are requested %d times, want 2", n)
+	}
+	if n := srv.Requests("GET", "/api/v0/monitors"); n != 1 {
+		t.Errorf("monitors are requested %d times, want 1", n)
+	}
+	info, err := fs.Stat(fsys, "hosts/web01/alerts/alert1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(now-3600, 0); !info.ModTime().Equal(want) {
+		t.Errorf("alert1 is modified at %v, want %v", info.ModTime(), want)
+	}
+
+	// Reloading fetches the alerts again.
+	srv.Update(func(f *mackereltest.Fixture) {
+		f.Alerts = append(f.Alerts, &mackerel.Alert{ID: "alert2", Status: "CRITICAL", HostID: "host1", OpenedAt: now})
+	})
+	if err := writeCtl(t, fsys, "hosts/web01/alerts/ctl", "reload"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "hosts/web01/alerts/alert2"); err != nil {
+		t.Errorf("reloaded alerts do not list alert2: %v", err)
+	}
+}
+
+func TestAlertHistory(t *testing.T) {
+	now := time.Now().Unix()
+	fixture := testFixture()
+	fixture.Alerts = []*mackerel.Alert{
+		{ID: "alert1", Status: "OK", HostID: "host1", OpenedAt: now - 3600, ClosedAt: now - 60},
+		{ID: "alert2", Status: "OK", HostID: "host2", OpenedAt: now - 10*24*3600, ClosedAt: now - 10*24*3600 + 60},
+	}
+	fsys, srv := newTestOrgFS(t, fixture)
+
+	days, err := fs.ReadDir(fsys, "alerts/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != alertHistoryDays+1 {
+		t.Errorf("alerts/history lists %d files, want %d days and ctl", len(days), alertHistoryDays)
+	}
+	if n := srv.Requests("GET", "/api/v0/alerts"); n != 0 {
+		t.Errorf("alerts are requested %d times to list the days", n)
+	}
+	day := func(t int64) string { return time.Unix(t, 0).UTC().Format(time.DateOnly) }
+	for _, d := range []string{day(now - 3600), day(now - 10*24*3600), day(now - 20*24*3600)} {
+		if _, err := fs.ReadDir(fsys, "alerts/history/"+d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.Requests("GET", "/api/v0/alerts"); n != 1 {
+		t.Errorf("alerts are requested %d times for 3 days, want 1", n)
+	}
+
+	srv.Update(func(f *mackereltest.Fixture) {
+		f.Alerts = append([]*mackerel.Alert{{ID: "alert3", Status: "CRITICAL", HostID: "host1", OpenedAt: now}}, f.Alerts...)
+	})
+	if err := writeCtl(t, fsys, "alerts/history/ctl", "reload"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "alerts/history/"+day(now)+"/alert3"); err != nil {
+		t.Errorf("reloaded history does not list alert3: %v", err)
+	}
+}
+
+func TestAlertMemo(t *testing.T) {
+	fixture := testFixture()
+	fixture.Alerts = []*mackerel.Alert{
+		{ID: "alert1", Status: "CRITICAL", HostID: "host1", OpenedAt: time.Now().Unix(), Memo: "looking"},
+	}
+	fsys, srv := newTestOrgFS(t, fixture)
+	readMemo := func() string {
+		t.Helper()
+		b, err := fs.ReadFile(fsys, "hosts/web01/alerts/alert1/memo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Listing the alert describes the memo without fetching it.
+	ents, err := fs.ReadDir(fsys, "alerts/alert1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range ents {
+		if _, err := e.Info(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := fs.Stat(fsys, "alerts/alert1/memo"); err != nil || info.Size() != int64(len("looking\n")) {
+		t.Errorf("Stat of memo returns %v, %v", info, err)
+	}
+	if n := srv.Requests("GET", "/api/v0/alerts/alert1"); n != 0 {
+		t.Errorf("alert is fetched %d times before reading the memo", n)
+	}
+	if got, want := readMemo(), "looking\n"; got != want {
+		t.Errorf("memo is %q, want %q", got, want)
+	}
+	// The memo is read on open, not when the alerts are listed.
+	srv.Update(func(f *mackereltest.Fixture) { f.Alerts[0].Memo = "still looking" })
+	if got, want := readMemo(), "still looking\n"; got != want {
+		t.Errorf("memo is %q, want %q", got, want)
+	}
+
+	if err := writeCtl(t, fsys, "alerts/alert1/memo", "rolled back deploy 1234"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Update(func(f *mackereltest.Fixture) {
+		if got, want := f.Alerts[0].Memo, "rolled back deploy 1234"; got != want {
+			t.Errorf("updated memo is %q, want %q", got, want)
+		}
+	})
+	if n := srv.Requests("PUT", "/api/v0/alerts/alert1"); n != 1 {
+		t.Errorf("alert is updated %d times, want 1", n)
+	}
+
+	// : > memo clears the memo.
+	f, err := extfs.OpenFile(fsys, "alerts/alert1/memo", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemo(); got != "" {
+		t.Errorf("memo is %q after truncated, want empty", got)
+	}
+}
@@ -16,8 +16,8 @@ type metricsFetcher interface {
 	Fetch(name string, from, to int64) ([]mackerel.MetricValue, error)
 }
 
-func metricFS(m metricsFetcher) fs.FS {
-	return itemFS(func() (Seq2[string, fs.FS], error) {
+func metricFS(c *client, dir string, m metricsFetcher) fs.FS {
+	return itemFS(c, dir, func() (Seq2[string, fs.FS], error) {
 		names, err := m.ListNames()
 		if err != nil {
 			return nil, err
@@ -34,17 +34,23 @@ func metricFS(m metricsFetcher) fs.FS {
 
 func metricTSDBFS(f metricsFetcher, name string) fs.FS {
 	m := muxfs.NewFS()
-	m.File("1hour", muxfs.ReaderFile(func() (io.Reader, error) {
+	m.File("1hour", muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
 		now := time.Now()
 		values, err := f.Fetch(name, now.Add(-time.Hour).Unix(), now.Unix())
 		if err != nil {
-			return nil, err
+			return nil, time.Time{}, fsError(err)
 		}
 		b := new(bytes.Buffer)
+		var last int64
 		for _, v := range values {
 			fmt.Fprintf(b, "%s\t%f\t%d\n", name, v.Value, v.Time)
+			last = max(last, v.Time)
+		}
+		var modTime time.Time
+		if last > 0 {
+			modTime = time.Unix(last, 0)
 		}
-		return b, err
+		return bytes.NewReader(b.Bytes()), modTime, err
 	}))
 	return m
 }
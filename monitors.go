@@ -0,0 +1,59 @@
+package mackerelfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
+)
+
+// monitorsFS returns the file system of the monitors of an organization,
+// listed by ID. Removing a directory deletes the monitor.
+func monitorsFS(c *client, dir string) fs.FS {
+	return removableItemFS(c, dir, func() (Seq2[string, fs.FS], error) {
+		monitors, err := c.FindMonitors()
+		now := time.Now()
+		return func(yield func(string, fs.FS) bool) {
+			for _, v := range monitors {
+				if !yield(v.MonitorID(), monitorFS(v, now)) {
+					return
+				}
+			}
+		}, err
+	}, func(id string) error {
+		_, err := c.DeleteMonitor(id)
+		return err
+	})
+}
+
+func monitorFS(v mackerel.Monitor, loaded time.Time) fs.FS {
+	m := muxfs.NewFS()
+	m.ModTime(func() time.Time { return loaded })
+	m.IgnoreRemove()
+	m.File("name", muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+		return strings.NewReader(v.MonitorName() + "\n"), loaded, nil
+	}))
+	m.File("type", muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+		return strings.NewReader(v.MonitorType() + "\n"), loaded, nil
+	}))
+	m.File("info", jsonFile(v, loaded))
+	return m
+}
+
+// jsonFile returns the file of v encoded in indented JSON.
+func jsonFile(v any, modTime time.Time) muxfs.File {
+	return muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+		b := new(bytes.Buffer)
+		enc := json.NewEncoder(b)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return nil, time.Time{}, err
+		}
+		return bytes.NewReader(b.Bytes()), modTime, nil
+	})
+}
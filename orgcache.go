@@ -0,0 +1,67 @@
+package mackerelfs
+
+import "sync"
+
+// OrgCache holds organizations shared by root file systems. See
+// Options.Cache. An organization is kept while any file system has it
+// registered.
+type OrgCache struct {
+	mu sync.Mutex
+	m  map[string]*cacheEntry // by API base URL and key
+}
+
+type cacheEntry struct {
+	ready chan struct{} // closed when org or err is set
+	org   *org
+	err   error
+	refs  int
+}
+
+// NewOrgCache returns an empty OrgCache.
+func NewOrgCache() *OrgCache {
+	return &OrgCache{m: make(map[string]*cacheEntry)}
+}
+
+// get returns the organization cached for key, calling build if it is not
+// cached. Each successful get should be followed by release.
+func (c *OrgCache) get(key string, build func() (*org, error)) (*org, error) {
+	c.mu.Lock()
+	e, ok := c.m[key]
+	if !ok {
+		e = &cacheEntry{ready: make(chan struct{})}
+		c.m[key] = e
+	}
+	e.refs++
+	c.mu.Unlock()
+
+	if !ok {
+		e.org, e.err = build()
+		close(e.ready)
+	}
+	<-e.ready
+	if e.err != nil {
+		c.release(key)
+		return nil, e.err
+	}
+	return e.org, nil
+}
+
+func (c *OrgCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return
+	}
+	e.refs--
+	if e.refs <= 0 {
+		delete(c.m, key)
+	}
+}
+
+// len returns the number of cached organizations.
+func (c *OrgCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
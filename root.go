@@ -1,56 +1,360 @@
 package mackerelfs
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"maps"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mackerelio/mackerel-client-go"
 	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
 )
 
-type root map[string]orgs
+const defaultBaseURL = "https://api.mackerelio.com/"
 
-type orgs struct {
-	api  string
-	fsys fs.FS
+// Options configures the file system returned by NewFS.
+type Options struct {
+	// BaseURL is the URL of the Mackerel API.
+	// If empty, the public endpoint https://api.mackerelio.com/ is used.
+	BaseURL string
+
+	// Transport is used to send API requests.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// Limits bounds the API requests sent for each organization.
+	Limits Limits
+
+	// Cache, if non-nil, shares organizations among the file systems
+	// using the same cache: those registering the same API key share the
+	// file system of the organization and the data fetched for it.
+	// The file systems should be configured by the same Options
+	// other than Cache.
+	Cache *OrgCache
+
+	// StateFile, if not empty, is the file which records the registered
+	// organizations and their API keys, so that they are registered again
+	// by NewFS. It is written with permission 0600.
+	StateFile string
+
+	// ReadOnly makes the operations changing the organizations, such as
+	// registering and retiring hosts, fail with fs.ErrPermission. The
+	// ctl files and the registration of organizations are not affected.
+	ReadOnly bool
+
+	// PollInterval is the interval of polling the alerts while
+	// alerts/events is read, and the hosts while hosts/changes is read.
+	// If zero, DefaultPollInterval is used.
+	PollInterval time.Duration
+}
+
+type root struct {
+	opts Options
+
+	mu       sync.Mutex
+	orgs     map[string]*mount        // by mount name
+	pending  map[string]*pendingEntry // entries of the state file failed to load
+	stateErr error                    // error reading the state file
+
+	saveMu sync.Mutex // serializes saveState
+}
+
+// mount is an organization registered in the root.
+type mount struct {
+	alias     string // mount name given by "new ... as", or empty
+	apikeyRef string // reference to the API key from the state file, or empty
+	*org
+}
+
+// reserved are the names of the files of the root, which cannot be used
+// as mount names.
+var reserved = map[string]bool{
+	".":      true,
+	"..":     true,
+	"ctl":    true,
+	"orgs":   true,
+	"status": true,
 }
 
+// FS returns the file system with the default options.
 func FS() fs.FS {
-	r := root{}
+	return NewFS(nil)
+}
+
+// NewFS returns the file system configured by o. A nil o is the same as
+// the zero Options.
+//
+// The returned file system implements io.Closer. Close releases the
+// organizations it shares through Options.Cache.
+func NewFS(o *Options) fs.FS {
+	r := &root{
+		orgs:    make(map[string]*mount),
+		pending: make(map[string]*pendingEntry),
+	}
+	if o != nil {
+		r.opts = *o
+	}
+	if r.opts.StateFile != "" {
+		r.loadState()
+	}
 	m := muxfs.NewFS()
-	m.File("ctl", muxfs.CtlFile(r.ctlFile))
+	m.File("ctl", muxfs.CtlFileUsage(rootUsage, r.ctlFile))
+	m.File("status", muxfs.ReaderFile(func() (io.Reader, error) {
+		return bytes.NewReader(r.status()), nil
+	}))
+	m.File("orgs", muxfs.ReaderFile(func() (io.Reader, error) {
+		return bytes.NewReader(r.list()), nil
+	}))
 	m.VarFS(r)
-	return m
+	return &rootFS{FS: m, r: r}
 }
 
-func (r root) ctlFile(s string) error {
+type rootFS struct {
+	*muxfs.FS
+	r *root
+}
+
+func (f *rootFS) Close() error {
+	f.r.close()
+	return nil
+}
+
+const rootUsage = `new apikey [as alias]
+delete name
+rename old new
+`
+
+func (r *root) ctlFile(s string) error {
 	f := strings.Fields(s)
 	if len(f) < 1 {
 		return nil
 	}
 	switch f[0] {
 	case "new":
-		if len(f) == 1 {
+		// new apikey [as alias]
+		var err error
+		switch {
+		case len(f) == 2:
+			err = r.add(f[1], "", "")
+		case len(f) == 4 && f[2] == "as":
+			err = r.add(f[1], f[3], "")
+		case len(f) < 2:
 			return errors.New("missing arguments")
+		default:
+			return errors.New("usage: new apikey [as alias]")
 		}
-		name, fsys, err := orgFS(newClient(f[1]))
 		if err != nil {
 			return err
 		}
-		r[name] = orgs{api: f[1], fsys: fsys}
 	case "delete":
 		if len(f) == 1 {
 			return errors.New("missing arguments")
 		}
-		delete(r, f[1])
+		if err := r.delete(f[1]); err != nil {
+			return err
+		}
+	case "rename":
+		if len(f) != 3 {
+			return errors.New("usage: rename old new")
+		}
+		if err := r.rename(f[1], f[2]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown command %q", f[0])
+	}
+	return r.saveState()
+}
+
+// add registers the organization of apikey as alias, or by its name if
+// alias is empty. apikeyRef is the reference to apikey in the state file.
+func (r *root) add(apikey, alias, apikeyRef string) error {
+	if alias != "" {
+		if err := checkName(alias); err != nil {
+			return err
+		}
+	}
+	o, err := r.newOrg(apikey)
+	if err != nil {
+		return err
+	}
+	name := alias
+	if name == "" {
+		name = o.name
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err = checkName(name)
+	if err == nil && r.orgs[name] != nil {
+		err = fmt.Errorf("%s: %w", name, fs.ErrExist)
+	}
+	if err != nil {
+		r.release(o)
+		return err
+	}
+	r.orgs[name] = &mount{alias: alias, apikeyRef: apikeyRef, org: o}
+	delete(r.pending, name)
+	return nil
+}
+
+func (r *root) delete(name string) error {
+	r.mu.Lock()
+	m, ok := r.orgs[name]
+	delete(r.orgs, name)
+	_, pending := r.pending[name]
+	delete(r.pending, name)
+	r.mu.Unlock()
+	if !ok && !pending {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if ok {
+		r.release(m.org)
 	}
 	return nil
 }
 
-func (r root) All() (muxfs.Seq[string], error) {
+func (r *root) rename(oldName, newName string) error {
+	if err := checkName(newName); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.orgs[oldName]
+	if !ok {
+		return fmt.Errorf("%s: %w", oldName, fs.ErrNotExist)
+	}
+	if newName == oldName {
+		return nil
+	}
+	if r.orgs[newName] != nil {
+		return fmt.Errorf("%s: %w", newName, fs.ErrExist)
+	}
+	delete(r.orgs, oldName)
+	alias := newName
+	if newName == m.name {
+		alias = ""
+	}
+	r.orgs[newName] = &mount{alias: alias, apikeyRef: m.apikeyRef, org: m.org}
+	return nil
+}
+
+// checkName reports whether name can be a mount name.
+func checkName(name string) error {
+	if reserved[name] || strings.Contains(name, "/") {
+		return fmt.Errorf("%q: %w: reserved or malformed name", name, fs.ErrInvalid)
+	}
+	return nil
+}
+
+// newOrg returns the organization of apikey, shared through the cache
+// if any.
+func (r *root) newOrg(apikey string) (*org, error) {
+	key := r.baseURL() + " " + apikey
+	build := func() (*org, error) {
+		c, err := r.newClient(apikey)
+		if err != nil {
+			return nil, err
+		}
+		o, err := newOrg(c)
+		if err != nil {
+			return nil, err
+		}
+		o.key = key
+		return o, nil
+	}
+	if r.opts.Cache == nil {
+		return build()
+	}
+	return r.opts.Cache.get(key, build)
+}
+
+func (r *root) release(o *org) {
+	if r.opts.Cache != nil {
+		r.opts.Cache.release(o.key)
+	}
+}
+
+// close deletes all organizations.
+func (r *root) close() {
+	r.mu.Lock()
+	orgs := r.orgs
+	r.orgs = make(map[string]*mount)
+	r.mu.Unlock()
+	for _, m := range orgs {
+		r.release(m.org)
+	}
+}
+
+// status returns the content of the global status file, which sums up
+// the status of each organization under the key prefix "org.<name>.".
+func (r *root) status() []byte {
+	r.mu.Lock()
+	orgs := maps.Clone(r.orgs)
+	pending := maps.Clone(r.pending)
+	stateErr := r.stateErr
+	r.mu.Unlock()
+
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "orgs=%d\n", len(orgs))
+	if r.opts.StateFile != "" {
+		fmt.Fprintf(b, "state.file=%s\n", r.opts.StateFile)
+	}
+	if stateErr != nil {
+		fmt.Fprintf(b, "state.error=%s\n", oneLine(stateErr))
+	}
+	for _, name := range sortedKeys(pending) {
+		fmt.Fprintf(b, "state.pending.%s=%s\n", name, oneLine(pending[name].err))
+	}
+	for _, name := range sortedKeys(orgs) {
+		c := orgs[name].client
+		calls, errors, hits, misses := c.stats.totals()
+		fmt.Fprintf(b, "org.%s.api=%s\n", name, c.BaseURL)
+		fmt.Fprintf(b, "org.%s.apikey=%s\n", name, maskKey(c.APIKey))
+		fmt.Fprintf(b, "org.%s.calls=%d\n", name, calls)
+		fmt.Fprintf(b, "org.%s.errors=%d\n", name, errors)
+		fmt.Fprintf(b, "org.%s.cache.ratio=%.3f\n", name, hitRatio(hits, misses))
+		fmt.Fprintf(b, "org.%s.ratelimit.tokens=%.2f\n", name, c.transport.limiter.Tokens())
+	}
+	return b.Bytes()
+}
+
+// oneLine returns the message of err on a line.
+func oneLine(err error) string {
+	return strings.ReplaceAll(err.Error(), "\n", " ")
+}
+
+// list returns the content of the orgs file, which lists the mount name,
+// the organization name, the alias or "-", and the API base URL of each
+// registered organization, separated by tabs.
+func (r *root) list() []byte {
+	r.mu.Lock()
+	orgs := maps.Clone(r.orgs)
+	r.mu.Unlock()
+
+	b := new(bytes.Buffer)
+	for _, name := range sortedKeys(orgs) {
+		m := orgs[name]
+		alias := m.alias
+		if alias == "" {
+			alias = "-"
+		}
+		fmt.Fprintf(b, "%s\t%s\t%s\t%s\n", name, m.name, alias, m.client.BaseURL)
+	}
+	return b.Bytes()
+}
+
+func (r *root) All() (muxfs.Seq[string], error) {
+	r.mu.Lock()
+	names := sortedKeys(r.orgs)
+	r.mu.Unlock()
 	return func(yield func(string) bool) {
-		for k := range r {
+		for _, k := range names {
 			if !yield(k) {
 				return
 			}
@@ -58,27 +362,71 @@ func (r root) All() (muxfs.Seq[string], error) {
 	}, nil
 }
 
-func (r root) FS(name string) (fs.FS, bool) {
-	f, ok := r[name]
-	return f.fsys, ok
+func (r *root) FS(name string) (fs.FS, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.orgs[name]
+	if !ok {
+		return nil, false
+	}
+	return m.fsys, true
 }
 
-func orgFS(c *mackerel.Client) (name string, fsys fs.FS, err error) {
+// org is the file system of an organization.
+type org struct {
+	key    string // API base URL and key
+	name   string
+	fsys   fs.FS
+	client *client
+}
+
+func newOrg(c *client) (*org, error) {
+	name, fsys, err := orgFS(c)
+	if err != nil {
+		return nil, err
+	}
+	return &org{name: name, fsys: fsys, client: c}, nil
+}
+
+func orgFS(c *client) (name string, fsys fs.FS, err error) {
 	org, err := c.GetOrg()
 	if err != nil {
-		return "", nil, err
+		return "", nil, fsError(err)
 	}
+	now := time.Now()
 	m := muxfs.NewFS()
-	m.FS("hosts", hostsFS(c))
-	m.FS("service", servicesFS(c))
+	m.ModTime(func() time.Time { return now })
+	m.FS("hosts", hostsFS(c, "hosts"))
+	m.FS("service", servicesFS(c, "service"))
+	m.FS("monitors", monitorsFS(c, "monitors"))
+	m.FS("alerts", alertsFS(c, "alerts"))
+	m.File("status", muxfs.ReaderFile(func() (io.Reader, error) {
+		return bytes.NewReader(c.status(org.Name)), nil
+	}))
 	return org.Name, m, nil
 }
 
-func newClient(apikey string) *mackerel.Client {
-	client, _ := mackerel.NewClientWithOptions(
+func (r *root) baseURL() string {
+	if r.opts.BaseURL == "" {
+		return defaultBaseURL
+	}
+	return r.opts.BaseURL
+}
+
+func (r *root) newClient(apikey string) (*client, error) {
+	client, err := mackerel.NewClientWithOptions(
 		apikey,
-		"https://api.mackerelio.com/",
+		r.baseURL(),
 		true,
 	)
-	return client
+	if err != nil {
+		return nil, err
+	}
+	if r.opts.Transport != nil {
+		client.HTTPClient.Transport = r.opts.Transport
+	}
+	c := newOrgClient(client, r.opts.Limits)
+	c.readOnly = r.opts.ReadOnly
+	c.pollInterval = r.opts.PollInterval
+	return c, nil
 }
@@ -1,20 +1,23 @@
 package mackerelfs
 
 import (
+	"bytes"
 	"io"
 	"io/fs"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/mackerelio/mackerel-client-go"
 	"github.com/rmatsuoka/mackerelfs/internal/muxfs"
 )
 
-func servicesFS(c *mackerel.Client) fs.FS {
-	return itemFS(func() (Seq2[string, fs.FS], error) {
+func servicesFS(c *client, dir string) fs.FS {
+	return itemFS(c, dir, func() (Seq2[string, fs.FS], error) {
 		services, err := c.FindServices()
 		return func(yield func(string, fs.FS) bool) {
 			for _, v := range services {
-				if !yield(v.Name, serviceFS(c, v.Name)) {
+				if !yield(v.Name, serviceFS(c, path.Join(dir, v.Name), v.Name)) {
 					return
 				}
 			}
@@ -23,20 +26,23 @@ func servicesFS(c *mackerel.Client) fs.FS {
 
 }
 
-func serviceFS(c *mackerel.Client, name string) fs.FS {
+func serviceFS(c *client, dir, name string) fs.FS {
 	m := muxfs.NewFS()
-	m.FS("metrics", metricFS(&serviceMetricFetcher{name: name, Client: c}))
-	varFS := newItemVarFS(func() (Seq2[string, fs.FS], error) {
+	m.FS("metrics", metricFS(c, path.Join(dir, "metrics"), &serviceMetricFetcher{name: name, client: c}))
+	m.FS("annotations", annotationsFS(c, path.Join(dir, "annotations"), name))
+	m.FS("alerts", serviceAlertsFS(c, path.Join(dir, "alerts"), name))
+	varFS := newItemVarFS(c, dir, func() (Seq2[string, fs.FS], error) {
 		roles, err := c.FindRoles(name)
+		now := time.Now()
 		return func(yield func(string, fs.FS) bool) {
 			for _, r := range roles {
-				if !yield(r.Name, roleFS(c, name, r.Name, r.Memo)) {
+				if !yield(r.Name, roleFS(c, path.Join(dir, r.Name), name, r.Name, r.Memo, now)) {
 					return
 				}
 			}
 		}, err
 	})
-	m.File("ctl", muxfs.CtlFile(func(s string) error {
+	m.File("ctl", muxfs.CtlFileUsage("reload", func(s string) error {
 		f := strings.Fields(s)
 		if len(f) > 0 && f[0] == "reload" {
 			if err := varFS.reload(); err != nil {
@@ -46,12 +52,13 @@ func serviceFS(c *mackerel.Client, name string) fs.FS {
 		return nil
 	}))
 	m.VarFS(varFS)
+	m.ModTime(varFS.modTime)
 	return m
 }
 
 type serviceMetricFetcher struct {
 	name string
-	*mackerel.Client
+	*client
 }
 
 func (s *serviceMetricFetcher) ListNames() ([]string, error) {
@@ -62,23 +69,15 @@ func (s *serviceMetricFetcher) Fetch(name string, from, to int64) ([]mackerel.Me
 	return s.FetchServiceMetricValues(s.name, name, from, to)
 }
 
-func roleFS(c *mackerel.Client, serviceName, roleName, memo string) fs.FS {
+func roleFS(c *client, dir, serviceName, roleName, memo string, loaded time.Time) fs.FS {
 	m := muxfs.NewFS()
-	varFS := newItemVarFS(func() (Seq2[string, fs.FS], error) {
-		hosts, err := c.FindHosts(&mackerel.FindHostsParam{
-			Service: serviceName,
-			Roles:   []string{roleName},
-		})
-		return func(yield func(string, fs.FS) bool) {
-			for _, host := range hosts {
-				if !yield(host.Name, newHostFS(c, host.ID)) {
-					return
-				}
-			}
-		}, err
-	})
+	varFS := newItemVarFS(c, dir, findHosts(c, dir, &mackerel.FindHostsParam{
+		Service: serviceName,
+		Roles:   []string{roleName},
+	}))
 	m.VarFS(varFS)
-	m.File("ctl", muxfs.CtlFile(func(s string) error {
+	m.ModTime(varFS.modTime)
+	m.File("ctl", muxfs.CtlFileUsage("reload", func(s string) error {
 		f := strings.Fields(s)
 		if len(f) > 0 && f[0] == "reload" {
 			if err := varFS.reload(); err != nil {
@@ -87,8 +86,58 @@ func roleFS(c *mackerel.Client, serviceName, roleName, memo string) fs.FS {
 		}
 		return nil
 	}))
-	m.File("memo", muxfs.ReaderFile(func() (io.Reader, error) {
-		return strings.NewReader(memo), nil
+	m.File("memo", muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+		return strings.NewReader(memo), loaded, nil
 	}))
 	return m
 }
+
+// annotationsWindow is how far back the graph annotations of a service are
+// listed.
+const annotationsWindow = 30 * 24 * time.Hour
+
+// annotationsFS returns the file system of the graph annotations of the
+// service in annotationsWindow, listed by ID. Removing a directory deletes
+// the annotation.
+func annotationsFS(c *client, dir, serviceName string) fs.FS {
+	return removableItemFS(c, dir, func() (Seq2[string, fs.FS], error) {
+		now := time.Now()
+		annotations, err := c.FindGraphAnnotations(serviceName, now.Add(-annotationsWindow).Unix(), now.Unix())
+		return func(yield func(string, fs.FS) bool) {
+			for _, v := range annotations {
+				if !yield(v.ID, annotationFS(v, now)) {
+					return
+				}
+			}
+		}, err
+	}, func(id string) error {
+		_, err := c.DeleteGraphAnnotation(id)
+		return err
+	})
+}
+
+func annotationFS(v *mackerel.GraphAnnotation, loaded time.Time) fs.FS {
+	m := muxfs.NewFS()
+	m.ModTime(func() time.Time { return loaded })
+	m.IgnoreRemove()
+	for name, format := range map[string]func(b *bytes.Buffer){
+		"title":       func(b *bytes.Buffer) { line(b, v.Title) },
+		"description": func(b *bytes.Buffer) { line(b, v.Description) },
+		"from":        func(b *bytes.Buffer) { timeLine(b, v.From) },
+		"to":          func(b *bytes.Buffer) { timeLine(b, v.To) },
+		"roles": func(b *bytes.Buffer) {
+			for _, role := range v.Roles {
+				line(b, role)
+			}
+		},
+	} {
+		format := format
+		m.File(name, muxfs.ModReaderFile(func() (io.Reader, time.Time, error) {
+			b := new(bytes.Buffer)
+			format(b)
+			return bytes.NewReader(b.Bytes()), loaded, nil
+		}))
+	}
+	m.File("info", jsonFile(v, loaded))
+	return m
+}
@@ -0,0 +1,157 @@
+package mackerelfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// state is the content of Options.StateFile.
+type state struct {
+	Orgs []stateEntry `json:"orgs"`
+}
+
+// stateEntry is a registered organization. Either APIKey or APIKeyRef is
+// set.
+type stateEntry struct {
+	// Org is the name of the organization. It is used as the mount name
+	// if Alias is empty.
+	Org   string `json:"org"`
+	Alias string `json:"alias,omitempty"`
+
+	APIKey string `json:"apikey,omitempty"`
+
+	// APIKeyRef refers to the API key instead of APIKey, as env:NAME for
+	// the environment variable NAME or file:PATH for the content of the
+	// file PATH. It is only read from the state file, which is written by
+	// the operator; the root ctl does not accept references.
+	APIKeyRef string `json:"apikeyRef,omitempty"`
+}
+
+func (e *stateEntry) mountName() string {
+	if e.Alias != "" {
+		return e.Alias
+	}
+	return e.Org
+}
+
+func (e *stateEntry) apikey() (string, error) {
+	if e.APIKeyRef == "" {
+		if e.APIKey == "" {
+			return "", errors.New("no API key")
+		}
+		return e.APIKey, nil
+	}
+	kind, v, _ := strings.Cut(e.APIKeyRef, ":")
+	switch kind {
+	case "env":
+		key := os.Getenv(v)
+		if key == "" {
+			return "", fmt.Errorf("environment variable %s is not set", v)
+		}
+		return key, nil
+	case "file":
+		b, err := os.ReadFile(v)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", fmt.Errorf("unknown API key reference %q", e.APIKeyRef)
+}
+
+// loadState registers the organizations recorded in the state file.
+// Entries which fail to be registered are kept in the state file and
+// reported in the status file.
+func (r *root) loadState() {
+	b, err := os.ReadFile(r.opts.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	var s state
+	if err == nil {
+		err = json.Unmarshal(b, &s)
+	}
+	if err != nil {
+		// Do not overwrite the file which we cannot understand.
+		r.stateErr = err
+		return
+	}
+	for _, e := range s.Orgs {
+		apikey, err := e.apikey()
+		if err == nil {
+			err = r.add(apikey, e.Alias, e.APIKeyRef)
+		}
+		if err != nil {
+			r.pending[e.mountName()] = &pendingEntry{stateEntry: e, err: err}
+		}
+	}
+}
+
+type pendingEntry struct {
+	stateEntry
+	err error
+}
+
+// saveState writes the registered organizations to the state file.
+// It does nothing if Options.StateFile is empty.
+func (r *root) saveState() error {
+	if r.opts.StateFile == "" {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	if r.stateErr != nil {
+		r.mu.Unlock()
+		return fmt.Errorf("state file is not saved: %w", r.stateErr)
+	}
+	var s state
+	for _, name := range sortedKeys(r.orgs) {
+		m := r.orgs[name]
+		e := stateEntry{Org: m.name, Alias: m.alias, APIKeyRef: m.apikeyRef}
+		if e.APIKeyRef == "" {
+			e.APIKey = m.client.APIKey
+		}
+		s.Orgs = append(s.Orgs, e)
+	}
+	for _, name := range sortedKeys(r.pending) {
+		if r.orgs[name] == nil {
+			s.Orgs = append(s.Orgs, r.pending[name].stateEntry)
+		}
+	}
+	r.mu.Unlock()
+
+	b, err := json.MarshalIndent(&s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.opts.StateFile, append(b, '\n'))
+}
+
+// writeFileAtomic replaces the file name with b, readable only by the
+// owner.
+func writeFileAtomic(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
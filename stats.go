@@ -0,0 +1,138 @@
+package mackerelfs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stats counts the activity of the file systems of an organization.
+type stats struct {
+	mu          sync.Mutex
+	calls       map[string]int // by endpoint
+	errors      map[string]int // by endpoint
+	shared      int
+	cacheHits   int
+	cacheMisses int
+	reloads     map[string]time.Time // by directory
+}
+
+func newStats() *stats {
+	return &stats{
+		calls:   make(map[string]int),
+		errors:  make(map[string]int),
+		reloads: make(map[string]time.Time),
+	}
+}
+
+// call records a request sent to the API. failed reports whether the
+// request has failed or has been answered with an error status.
+func (s *stats) call(req *http.Request, failed bool) {
+	e := endpoint(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[e]++
+	if failed {
+		s.errors[e]++
+	}
+}
+
+// share records a response shared by coalesced requests.
+func (s *stats) share() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shared++
+}
+
+// cache records a lookup of a loaded directory. hit reports whether it is
+// answered without calling the API.
+func (s *stats) cache(hit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hit {
+		s.cacheHits++
+	} else {
+		s.cacheMisses++
+	}
+}
+
+// reload records the time when dir is reloaded.
+func (s *stats) reload(dir string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloads[dir] = t
+}
+
+// totals returns the total number of calls, errors, cache hits and misses.
+func (s *stats) totals() (calls, errors, hits, misses int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.calls {
+		calls += n
+	}
+	for _, n := range s.errors {
+		errors += n
+	}
+	return calls, errors, s.cacheHits, s.cacheMisses
+}
+
+// format writes s to b in the key=value format of status files.
+func (s *stats) format(b *bytes.Buffer) {
+	calls, errors, hits, misses := s.totals()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(b, "calls=%d\n", calls)
+	for _, k := range sortedKeys(s.calls) {
+		fmt.Fprintf(b, "calls.%s=%d\n", k, s.calls[k])
+	}
+	fmt.Fprintf(b, "errors=%d\n", errors)
+	for _, k := range sortedKeys(s.errors) {
+		fmt.Fprintf(b, "errors.%s=%d\n", k, s.errors[k])
+	}
+	fmt.Fprintf(b, "shared=%d\n", s.shared)
+	fmt.Fprintf(b, "cache.hits=%d\n", hits)
+	fmt.Fprintf(b, "cache.misses=%d\n", misses)
+	fmt.Fprintf(b, "cache.ratio=%.3f\n", hitRatio(hits, misses))
+	for _, k := range sortedKeys(s.reloads) {
+		fmt.Fprintf(b, "reload.%s=%s\n", k, s.reloads[k].UTC().Format(time.RFC3339))
+	}
+}
+
+func hitRatio(hits, misses int) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// literalElems are path elements of the API which are not identifiers.
+var literalElems = map[string]bool{
+	"bulk-retire":          true,
+	"bulk-update-statuses": true,
+	"latest":               true,
+}
+
+// endpoint returns the method and the path of req joined with ':', with
+// identifiers in the path replaced by '*', such as
+// "GET:/api/v0/hosts/*/metrics".
+func endpoint(req *http.Request) string {
+	elem := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v0/"), "/")
+	for i := 1; i < len(elem); i += 2 {
+		if !literalElems[elem[i]] {
+			elem[i] = "*"
+		}
+	}
+	return req.Method + ":/api/v0/" + strings.Join(elem, "/")
+}
+
+// maskKey hides all but the last 4 characters of an API key.
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return strings.Repeat("*", len(key))
+	}
+	return strings.Repeat("*", len(key)-4) + key[len(key)-4:]
+}